@@ -0,0 +1,284 @@
+package app
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/proxy"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/traffic"
+)
+
+var (
+    ErrAllProxiesDisabled = errors.New("both proxies are disabled in the listeners config")
+)
+
+// Options configures a server instance, empty listen addresses keep the config file values
+type Options struct {
+    ConfigPath      string
+    LogDir          string
+    Verbose         bool
+    HTTPListen      string
+    SOCKSListen     string
+    AdminListen     string
+    ShutdownTimeout time.Duration // How long to wait for in-flight connections when stopping
+}
+
+// App wires the configuration, logging, session store and proxies together
+type App struct {
+    Options      Options
+    Config       *config.Config
+    Logging      *logging.Logging
+    SessionStore session.SessionStore
+    Usage        *traffic.UsageStore
+    Metrics      *metrics.Metrics
+}
+
+// DefaultShutdownTimeout is used when Options.ShutdownTimeout is not set
+const DefaultShutdownTimeout = 30 * time.Second
+
+// New opens the log files and loads the configuration. On error everything
+// opened so far is closed again.
+func New(options Options) (*App, error) {
+    if options.ShutdownTimeout <= 0 {
+        options.ShutdownTimeout = DefaultShutdownTimeout
+    }
+
+    logg := logging.New(options.Verbose)
+    if err := logg.InitializeLogging(options.LogDir); err != nil {
+        logg.Close()
+        return nil, err
+    }
+
+    cfg, err := config.LoadConfig(options.ConfigPath, logg)
+    if err != nil {
+        logg.Close()
+        return nil, err
+    }
+    cfg.OverrideListenAddresses(options.HTTPListen, options.SOCKSListen, options.AdminListen)
+
+    a := &App{
+        Options: options,
+        Config:  cfg,
+        Logging: logg,
+        Metrics: metrics.New(),
+    }
+    a.SessionStore, err = a.newSessionStore()
+    if err != nil {
+        logg.Close()
+        return nil, err
+    }
+    if counter, ok := a.SessionStore.(session.Counter); ok {
+        a.Metrics.WatchSessions(counter.Count)
+    }
+    cfg.OnReload = a.Metrics.ConfigReloaded
+
+    a.Usage, err = traffic.NewUsageStore(cfg.GetUsageFile(), logg)
+    if err != nil {
+        a.SessionStore.Close()
+        logg.Close()
+        return nil, fmt.Errorf("failed to open traffic usage file %s: %w", cfg.GetUsageFile(), err)
+    }
+    return a, nil
+}
+
+// newSessionStore creates the session store backend selected in the config
+func (a *App) newSessionStore() (session.SessionStore, error) {
+    switch a.Config.GetSessionStore().Type {
+    case config.SessionStoreFile:
+        store, err := session.NewFileStore(a.Config.GetSessionStore().Path, a.Config.GetCleanupInterval(), a.Logging)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open session store %s: %w", a.Config.GetSessionStore().Path, err)
+        }
+        return store, nil
+    case config.SessionStoreSigned:
+        // Stateless tokens are checked against the current config on every request
+        store := session.NewTokenStore(a.Config.GetSigningKeys())
+        store.Validate = a.checkSession
+        return store, nil
+    default:
+        return session.NewMemoryStore(a.Config.GetCleanupInterval()), nil
+    }
+}
+
+// Run watches the configuration and starts the enabled proxies. It blocks until ctx
+// is cancelled or a proxy fails, then shuts everything down within ShutdownTimeout.
+func (a *App) Run(ctx context.Context) error {
+    defer a.Logging.Close()
+    defer a.SessionStore.Close()
+    defer a.Usage.Close()
+
+    listeners := a.Config.GetListeners()
+    if listeners.HTTP.Disabled && listeners.SOCKS.Disabled {
+        return ErrAllProxiesDisabled
+    }
+
+    // Watch configuration changes and re-check sessions after every reload
+    watcherDone := make(chan struct{})
+    defer close(watcherDone)
+    reloads := a.Config.Subscribe()
+    go a.Config.WatchConfig(watcherDone)
+    go a.revalidateSessionsOnReload(reloads, watcherDone)
+
+    // SIGHUP reopens the log files after an external logrotate moved them
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    defer signal.Stop(hangups)
+    go a.reopenLogsOnHangup(hangups, watcherDone)
+
+    var servers []server
+
+    // Failed logins on either proxy count towards the same lockouts
+    guard := proxy.NewAuthGuard(a.Config, a.Logging)
+    defer guard.Close()
+
+    // Traffic limits also apply to a user's HTTP and SOCKS5 traffic together
+    trafficControl := proxy.NewTrafficControl(a.Config, a.Logging, a.Usage)
+    defer trafficControl.Close()
+
+    // Start HTTP proxy (for HTTP/HTTPS traffic)
+    if !listeners.HTTP.Disabled {
+        servers = append(servers, proxy.NewHTTPProxy(a.Config, a.Logging, a.SessionStore, guard, trafficControl, a.Metrics))
+    }
+
+    // Start SOCKS5 proxy (for TCP traffic)
+    if !listeners.SOCKS.Disabled {
+        socksProxy, err := proxy.NewSOCKS5Proxy(a.Config, a.Logging, a.SessionStore, guard, trafficControl, a.Metrics)
+        if err != nil {
+            return err
+        }
+        servers = append(servers, socksProxy)
+    }
+
+    // Serve the metrics on their own listener, it is off unless an address is set
+    if admin := listeners.Admin; admin.Address != "" && !admin.Disabled {
+        servers = append(servers, metrics.NewAdminServer(admin.Address, a.Metrics, a.Logging))
+    }
+
+    errs := make(chan error, len(servers))
+    for _, srv := range servers {
+        go func(srv server) {
+            errs <- srv.ListenAndServe()
+        }(srv)
+    }
+
+    // Wait for a stop request or a failing proxy
+    logger := a.Logging.Component("app")
+    var runErr error
+    select {
+    case <-ctx.Done():
+        logger.Info("Shutting down, waiting for in-flight connections", "timeout", a.Options.ShutdownTimeout)
+    case runErr = <-errs:
+        logger.Error("Proxy stopped unexpectedly, shutting down", "error", runErr)
+    }
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), a.Options.ShutdownTimeout)
+    defer cancel()
+
+    var wg sync.WaitGroup
+    for _, srv := range servers {
+        wg.Add(1)
+        go func(srv server) {
+            defer wg.Done()
+            if err := srv.Shutdown(shutdownCtx); err != nil {
+                logger.Error("Error during shutdown", "error", err)
+            }
+        }(srv)
+    }
+    wg.Wait()
+
+    logger.Info("Server stopped")
+    return runErr
+}
+
+// server is implemented by both proxies
+type server interface {
+    ListenAndServe() error
+    Shutdown(ctx context.Context) error
+}
+
+// reopenLogsOnHangup reopens server.log and visited.log on every SIGHUP
+func (a *App) reopenLogsOnHangup(hangups <-chan os.Signal, done <-chan struct{}) {
+    for {
+        select {
+        case <-done:
+            return
+        case <-hangups:
+            a.Logging.Reopen()
+            a.Logging.Component("app").Info("Log files reopened")
+        }
+    }
+}
+
+// revalidateSessionsOnReload re-checks the live sessions whenever the config was reloaded
+func (a *App) revalidateSessionsOnReload(reloads <-chan struct{}, done <-chan struct{}) {
+    for {
+        select {
+        case <-done:
+            return
+        case <-reloads:
+            a.SessionStore.SetCleanupInterval(a.Config.GetCleanupInterval())
+            if tokens, ok := a.SessionStore.(*session.TokenStore); ok {
+                tokens.SetKeys(a.Config.GetSigningKeys())
+            }
+            a.revalidateSessions()
+        }
+    }
+}
+
+// revalidateSessions re-checks every live session against the current config
+// and logs a summary of what was revoked or updated.
+func (a *App) revalidateSessions() {
+    updated := 0
+    revoked := a.SessionStore.Revalidate(func(s *session.Session) bool {
+        previousTarget := s.TargetDomain
+        if !a.checkSession(s) {
+            return false
+        }
+        if s.TargetDomain != previousTarget {
+            updated++
+        }
+        return true
+    })
+
+    if len(revoked) == 0 && updated == 0 {
+        return
+    }
+
+    pairs := make([]string, len(revoked))
+    for i, s := range revoked {
+        pairs[i] = fmt.Sprintf("%s@%s", s.Username, s.DomainName)
+    }
+    sort.Strings(pairs)
+    a.Logging.Component("app").Info("Sessions revalidated after config reload",
+        "revoked", len(revoked), "revoked_sessions", strings.Join(pairs, ", "), "updated", updated)
+}
+
+// checkSession rejects a session whose user or mapping disappeared, whose user
+// lost access to the mapping or that expired under the current limits. Accepted
+// sessions get their mapping's current target and the user's current limits.
+func (a *App) checkSession(s *session.Session) bool {
+    if !a.Config.HasUser(s.Username) {
+        return false
+    }
+    mapping, exists := a.Config.GetMapping(s.DomainName)
+    if !exists || !a.Config.AuthorizeDomain(s.Username, s.DomainName) {
+        return false
+    }
+    s.TargetDomain = mapping.To
+
+    idleTimeout, maxLifetime := a.Config.GetSessionLimits(s.Username)
+    s.Limits = session.Limits{IdleTimeout: idleTimeout, MaxLifetime: maxLifetime}
+    return !s.Expired(time.Now())
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
+)
+
+// writeConfig writes a config file into dir and returns its path
+func writeConfig(t *testing.T, dir, name, content string) string {
+    t.Helper()
+    path := filepath.Join(dir, name)
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestNewReportsSetupErrors(t *testing.T) {
+    dir := t.TempDir()
+    valid := writeConfig(t, dir, "config.json", `{
+        "user_credentials": [{"username": "alice", "password": "secret"}],
+        "usage_file": "`+filepath.Join(dir, "usage.json")+`"
+    }`)
+    // The session file path is a directory and cannot be read
+    badSessions := writeConfig(t, dir, "sessions.json", `{"session_store": {"type": "file", "path": "`+dir+`"}}`)
+
+    for name, options := range map[string]Options{
+        "missing config":      {ConfigPath: filepath.Join(dir, "missing.json"), LogDir: dir},
+        "missing log dir":     {ConfigPath: valid, LogDir: filepath.Join(dir, "missing")},
+        "unreadable sessions": {ConfigPath: badSessions, LogDir: dir},
+    } {
+        if a, err := New(options); err == nil {
+            a.Usage.Close()
+            a.SessionStore.Close()
+            a.Logging.Close()
+            t.Errorf("%s: New succeeded", name)
+        }
+    }
+
+    a, err := New(Options{ConfigPath: valid, LogDir: dir})
+    if err != nil {
+        t.Fatalf("New: %s", err)
+    }
+    a.Usage.Close()
+    a.SessionStore.Close()
+    a.Logging.Close()
+}
+
+func TestSessionsRevalidatedOnReload(t *testing.T) {
+    dir := t.TempDir()
+    path := writeConfig(t, dir, "config.json", `{
+        "user_credentials": [
+            {"username": "alice", "password": "secret"},
+            {"username": "bob", "password": "secret"},
+            {"username": "carol", "password": "secret"},
+            {"username": "dave", "password": "secret"}
+        ],
+        "domain_mappings": [{"from": "github", "to": "https://github.com"}],
+        "logging": {"level": "error"}
+    }`)
+    logger := logging.New(false)
+    cfg, err := config.LoadConfig(path, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    store := session.NewMemoryStore(time.Minute)
+    defer store.Close()
+    a := &App{Config: cfg, Logging: logger, SessionStore: store, Metrics: metrics.New()}
+
+    tokens := make(map[string]string)
+    for _, username := range []string{"alice", "bob", "carol", "dave"} {
+        tokens[username], _, _ = store.CreateSession(username, "github", "https://github.com", "127.0.0.1", session.Limits{}, session.Quota{})
+    }
+    // dave's session is older than the lifetime the reload introduces
+    store.Revalidate(func(s *session.Session) bool {
+        if s.Username == "dave" {
+            s.CreatedAt = s.CreatedAt.Add(-2 * time.Hour)
+        }
+        return true
+    })
+
+    done := make(chan struct{})
+    defer close(done)
+    reloads := cfg.Subscribe()
+    go cfg.WatchConfig(done)
+    go a.revalidateSessionsOnReload(reloads, done)
+    // Give the watcher time to register the directory
+    time.Sleep(100 * time.Millisecond)
+
+    // bob is removed, carol loses access, dave gets a lifetime and the mapping moves
+    writeConfig(t, dir, "config.json", `{
+        "user_credentials": [
+            {"username": "alice", "password": "secret"},
+            {"username": "carol", "password": "secret", "denied_domains": ["github"]},
+            {"username": "dave", "password": "secret", "session_max_lifetime": "1h"}
+        ],
+        "domain_mappings": [{"from": "github", "to": "https://github.example.com"}],
+        "logging": {"level": "error"}
+    }`)
+
+    for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if _, exists := store.Lookup(tokens["bob"]); !exists {
+            break
+        }
+    }
+    for username, want := range map[string]bool{"alice": true, "bob": false, "carol": false, "dave": false} {
+        if _, exists := store.Lookup(tokens[username]); exists != want {
+            t.Errorf("session of %s live = %v after the reload, want %v", username, exists, want)
+        }
+    }
+    if s, _ := store.Lookup(tokens["alice"]); s.TargetDomain != "https://github.example.com" {
+        t.Errorf("alice's session targets %q, want the reloaded mapping", s.TargetDomain)
+    }
+}
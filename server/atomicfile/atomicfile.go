@@ -0,0 +1,43 @@
+package atomicfile
+
+import (
+    "os"
+    "path/filepath"
+)
+
+// Write replaces the file at path with data. The data is written to a temporary
+// file next to it, flushed to disk and renamed over it, so a crash or power
+// loss never leaves a truncated file. New files are only readable by the owner.
+func Write(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes a directory to disk, which makes a rename inside it durable
+func syncDir(path string) error {
+    dir, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return dir.Sync()
+}
@@ -0,0 +1,38 @@
+package atomicfile
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestWriteReplacesFile(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "state.json")
+    if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := Write(path, []byte("new")); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(path); string(data) != "new" {
+        t.Errorf("file contains %q, want %q", data, "new")
+    }
+
+    // The temporary file is gone and a new file is private
+    entries, _ := os.ReadDir(dir)
+    if len(entries) != 1 {
+        t.Errorf("%d files left in the directory, want 1", len(entries))
+    }
+    info, _ := os.Stat(path)
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("mode = %s, want 0600", info.Mode().Perm())
+    }
+}
+
+func TestWriteIntoMissingDirectory(t *testing.T) {
+    if err := Write(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("data")); err == nil {
+        t.Error("Write into a missing directory succeeded")
+    }
+}
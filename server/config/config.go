@@ -1,94 +1,313 @@
 package config
 
 import (
-    "encoding/json"
-    "io/ioutil"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
     "sync"
+    "time"
 
-    "github.com/fsnotify/fsnotify"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
 )
 
 type UserCredential struct {
-    Username string `json:"username"`
-    Password string `json:"password"`
+    Username       string   `json:"username"`
+    Password       string   `json:"password"`
+    AllowedDomains []string `json:"allowed_domains"` // Mapping names or glob patterns, empty allows all
+    DeniedDomains  []string `json:"denied_domains"`  // Mapping names or glob patterns, checked first
+    Admin          bool     `json:"admin"`           // May revoke sessions of other users
+
+    // Per-user overrides of the global session timing, unset values inherit it
+    SessionIdleTimeout *Duration `json:"session_idle_timeout"`
+    SessionMaxLifetime *Duration `json:"session_max_lifetime"`
+
+    // Per-user overrides of the global concurrent session limit
+    MaxSessions        *int   `json:"max_sessions"`
+    SessionLimitPolicy string `json:"session_limit_policy"`
+
+    Traffic TrafficLimits `json:"traffic"`
+
+    // How this user's visited addresses are logged, empty inherits logging.visited.mode
+    VisitedLog string `json:"visited_log"`
+}
+
+// TrafficLimits throttles and caps the traffic of a user, zero values disable a limit
+type TrafficLimits struct {
+    RequestsPerSecond        float64 `json:"requests_per_second"`         // HTTP requests and SOCKS5 connections of all the user's sessions
+    SessionRequestsPerSecond float64 `json:"session_requests_per_second"` // HTTP requests of a single session
+    Burst                    int     `json:"burst"`                       // Requests allowed at once, defaults to the rate rounded up
+    BytesPerSecond           int64   `json:"bytes_per_second"`            // Upload and download combined
+    DailyBytes               int64   `json:"daily_bytes"`                 // Quota per calendar day, UTC
+    MonthlyBytes             int64   `json:"monthly_bytes"`               // Quota per calendar month, UTC
 }
 
 type DomainMapping struct {
-    From string `json:"from"`
-    To   string `json:"to"`
+    From string     `json:"from"`
+    To   string     `json:"to"`
+    TLS  MappingTLS `json:"tls"`
+}
+
+// MappingTLS holds the TLS settings used towards a mapping's target host
+type MappingTLS struct {
+    CAFile       string `json:"ca_file"`       // PEM bundle used instead of the system roots
+    PinnedSHA256 string `json:"pinned_sha256"` // Hex fingerprint of the expected leaf certificate
+    ServerName   string `json:"server_name"`   // SNI and verification name override
+    Insecure     bool   `json:"insecure"`      // Skip certificate verification entirely
+}
+
+type SOCKSConfig struct {
+    RewriteNames bool `json:"rewrite_names"` // Let clients CONNECT to a mapping name such as "github"
+}
+
+// Default listen addresses of the proxies
+const (
+    DefaultHTTPAddress  = ":8080"
+    DefaultSOCKSAddress = ":1080"
+)
+
+// DefaultUsageFile keeps the traffic quota usage when usage_file is not set
+const DefaultUsageFile = "usage.json"
+
+// DefaultUpstreamIdleTimeout is used when upstream_idle_timeout is not set
+const DefaultUpstreamIdleTimeout = time.Minute
+
+// Default session timing, a session lifetime of zero means unlimited
+const (
+    DefaultSessionIdleTimeout = time.Minute
+    DefaultCleanupInterval    = 30 * time.Second
+)
+
+// What a handshake does when the user already has max_sessions live sessions
+const (
+    SessionLimitReject      = "reject"       // Refuse the new session (default)
+    SessionLimitEvictOldest = "evict_oldest" // End the oldest sessions to make room
+)
+
+// Default brute-force protection thresholds
+const (
+    DefaultMaxAttemptsPerIP   = 10
+    DefaultMaxAttemptsPerUser = 5
+    DefaultAttemptWindow      = 15 * time.Minute
+    DefaultLockout            = time.Minute
+    DefaultMaxLockout         = time.Hour
+)
+
+// BruteForceConfig locks out client IPs and usernames after repeated failed
+// authentications. Unset values use the defaults above.
+type BruteForceConfig struct {
+    Disabled           bool     `json:"disabled"`
+    MaxAttemptsPerIP   int      `json:"max_attempts_per_ip"`   // Failures before the client IP is locked out
+    MaxAttemptsPerUser int      `json:"max_attempts_per_user"` // Failures before the username is locked out
+    Window             Duration `json:"window"`                // Failures older than this are forgotten
+    Lockout            Duration `json:"lockout"`               // First lockout, doubled for every further one
+    MaxLockout         Duration `json:"max_lockout"`           // Upper bound of the doubled lockout
+}
+
+// LogConfig selects the level and format of server.log and the console output,
+// and the format of the access log in visited.log
+type LogConfig struct {
+    Level        string         `json:"level"`         // "debug", "info" (default), "warn" or "error"
+    Format       string         `json:"format"`        // "text" (default) or "json"
+    AccessFormat string         `json:"access_format"` // "json" (default), "common" or "combined"
+    Rotation     RotationConfig `json:"rotation"`
+    Visited      VisitedConfig  `json:"visited"`
+}
+
+// VisitedConfig controls how visited addresses appear in visited.log and server.log
+type VisitedConfig struct {
+    Mode              string   `json:"mode"`                // "full" (default), "host", "hashed" or "none"
+    RedactQueryParams []string `json:"redact_query_params"` // Glob patterns, unset uses logging.DefaultRedactedParams
+    HashKey           string   `json:"hash_key"`            // Key of the hashed mode, random per start if empty
+}
+
+// RotationConfig limits the size and age of server.log and visited.log. Rotated
+// files get a timestamp suffix, all limits are disabled when zero.
+type RotationConfig struct {
+    MaxSize    int64    `json:"max_size"`    // In bytes
+    MaxAge     Duration `json:"max_age"`     // Rotate once the current file is this old
+    MaxBackups int      `json:"max_backups"` // Rotated files to keep per log, 0 keeps all
+    Compress   bool     `json:"compress"`    // Gzip rotated files
+}
+
+// ListenerTLS enables TLS on a listener when both files are set
+type ListenerTLS struct {
+    CertFile string `json:"cert_file"`
+    KeyFile  string `json:"key_file"`
+}
+
+// Enabled reports whether TLS is configured
+func (t ListenerTLS) Enabled() bool {
+    return t.CertFile != "" && t.KeyFile != ""
+}
+
+type ListenerConfig struct {
+    Address  string      `json:"address"`  // host:port to bind
+    Disabled bool        `json:"disabled"` // Do not start this proxy at all
+    TLS      ListenerTLS `json:"tls"`      // Only used by the HTTP listener
+}
+
+type ListenersConfig struct {
+    HTTP  ListenerConfig `json:"http"`
+    SOCKS ListenerConfig `json:"socks"`
+    Admin ListenerConfig `json:"admin"` // Serves /metrics, only started when an address is set
+}
+
+// Session store backends
+const (
+    SessionStoreMemory = "memory"
+    SessionStoreFile   = "file"
+    SessionStoreSigned = "signed"
+)
+
+// SigningKey is an HMAC key for signed session tokens
+type SigningKey struct {
+    ID     string `json:"id"`     // Embedded in every token signed with this key
+    Secret string `json:"secret"` // Base64 encoded, at least 32 bytes
+}
+
+type SessionStoreConfig struct {
+    Type      string       `json:"type"`       // "memory" (default), "file" or "signed"
+    Path      string       `json:"path"`       // Snapshot file of the "file" store
+    Keys      []SigningKey `json:"keys"`       // Keys accepted by the "signed" store, reloadable for rotation
+    ActiveKey string       `json:"active_key"` // ID of the key new tokens are signed with
 }
 
 type Config struct {
     UserCredentials []UserCredential `json:"user_credentials"`
     DomainMappings  []DomainMapping  `json:"domain_mappings"`
+    SOCKS           SOCKSConfig      `json:"socks"`
+    MaxBodySize     int64            `json:"max_body_size"` // In bytes, 0 disables the limit
+    Listeners       ListenersConfig  `json:"listeners"`     // Read once at startup
+
+    // Longest an upstream connection may go without sending or accepting data
+    UpstreamIdleTimeout Duration `json:"upstream_idle_timeout"`
+
+    SessionIdleTimeout Duration `json:"session_idle_timeout"`
+    SessionMaxLifetime Duration `json:"session_max_lifetime"`
+    CleanupInterval    Duration `json:"cleanup_interval"`
+
+    MaxSessions        int    `json:"max_sessions"`         // Live sessions per user, 0 is unlimited
+    SessionLimitPolicy string `json:"session_limit_policy"` // "reject" (default) or "evict_oldest"
+
+    SessionStore SessionStoreConfig `json:"session_store"` // Only the signing keys are reloaded
+    BruteForce   BruteForceConfig   `json:"brute_force"`
+    UsageFile    string             `json:"usage_file"` // Traffic usage of the quotas, read once at startup
+    Log          LogConfig          `json:"logging"`
+
     ConfigPath      string
     Mutex           sync.RWMutex
     Logging         *logging.Logging
+    OnReload        func(err error) // Called after every reload attempt of WatchConfig, set before starting it
+    loaded          bool
+    hashKey         []byte // Used when logging.visited.hash_key is empty
+    subscribers     []chan struct{}
+    subscribersLock sync.Mutex
 }
 
-func LoadConfig(path string, logging *logging.Logging) *Config {
+// LoadConfig loads the config file at startup
+func LoadConfig(path string, logging *logging.Logging) (*Config, error) {
     cfg := &Config{
         ConfigPath: path,
-        Logging:    logging,
+        Logging:    logging.Component("config"),
+        hashKey:    make([]byte, 32),
+    }
+    if _, err := rand.Read(cfg.hashKey); err != nil {
+        return nil, fmt.Errorf("failed to generate the visited log hash key: %w", err)
+    }
+    if err := cfg.loadConfig(); err != nil {
+        return nil, fmt.Errorf("failed to load config %s: %w", path, err)
     }
-    cfg.loadConfig()
-    return cfg
+    return cfg, nil
 }
 
-func (c *Config) loadConfig() {
-    c.Mutex.Lock()
-    defer c.Mutex.Unlock()
-
-    data, err := ioutil.ReadFile(c.ConfigPath)
+// loadConfig reads, validates and applies the config file.
+// On error the currently active configuration is left untouched.
+func (c *Config) loadConfig() error {
+    tempConfig, err := readConfigFile(c.ConfigPath)
     if err != nil {
-        c.Logging.Fatalf("Failed to read config file: %s", err)
+        return err
     }
 
-    tempConfig := struct {
-        UserCredentials []UserCredential `json:"user_credentials"`
-        DomainMappings  []DomainMapping  `json:"domain_mappings"`
-    }{}
-
-    if err := json.Unmarshal(data, &tempConfig); err != nil {
-        c.Logging.Fatalf("Failed to parse config: %s", err)
+    // Apply the logging settings first, so that the messages below already use them
+    if err := c.Logging.Configure(tempConfig.Log.settings()); err != nil {
+        return err
     }
 
+    c.Mutex.Lock()
+    defer c.Mutex.Unlock()
+
     c.UserCredentials = tempConfig.UserCredentials
     c.DomainMappings = tempConfig.DomainMappings
+    c.SOCKS = tempConfig.SOCKS
+    c.MaxBodySize = tempConfig.MaxBodySize
+    c.UpstreamIdleTimeout = tempConfig.UpstreamIdleTimeout
+    c.SessionIdleTimeout = tempConfig.SessionIdleTimeout
+    c.SessionMaxLifetime = tempConfig.SessionMaxLifetime
+    c.CleanupInterval = tempConfig.CleanupInterval
+    c.MaxSessions = tempConfig.MaxSessions
+    c.SessionLimitPolicy = tempConfig.SessionLimitPolicy
+    c.BruteForce = tempConfig.BruteForce
+    c.Log = tempConfig.Log
 
-    c.Logging.Logln("Configuration loaded")
-}
-
-func (c *Config) WatchConfig() {
-    watcher, err := fsnotify.NewWatcher()
-    if err != nil {
-        c.Logging.Fatalf("Failed to create file watcher: %s", err)
+    if c.UpstreamIdleTimeout == 0 {
+        c.UpstreamIdleTimeout = Duration(DefaultUpstreamIdleTimeout)
+    }
+    if c.SessionIdleTimeout == 0 {
+        c.SessionIdleTimeout = Duration(DefaultSessionIdleTimeout)
+    }
+    if c.CleanupInterval == 0 {
+        c.CleanupInterval = Duration(DefaultCleanupInterval)
+    }
+    if c.SessionLimitPolicy == "" {
+        c.SessionLimitPolicy = SessionLimitReject
+    }
+    if c.BruteForce.MaxAttemptsPerIP == 0 {
+        c.BruteForce.MaxAttemptsPerIP = DefaultMaxAttemptsPerIP
+    }
+    if c.BruteForce.MaxAttemptsPerUser == 0 {
+        c.BruteForce.MaxAttemptsPerUser = DefaultMaxAttemptsPerUser
+    }
+    if c.BruteForce.Window == 0 {
+        c.BruteForce.Window = Duration(DefaultAttemptWindow)
+    }
+    if c.BruteForce.Lockout == 0 {
+        c.BruteForce.Lockout = Duration(DefaultLockout)
+    }
+    if c.BruteForce.MaxLockout == 0 {
+        c.BruteForce.MaxLockout = Duration(DefaultMaxLockout)
     }
-    defer watcher.Close()
 
-    err = watcher.Add(".")
-    if err != nil {
-        c.Logging.Fatalf("Failed to add directory to watcher: %s", err)
+    // Listeners and the session and usage stores cannot change while the proxies are running
+    if !c.loaded {
+        c.UsageFile = tempConfig.UsageFile
+        if c.UsageFile == "" {
+            c.UsageFile = DefaultUsageFile
+        }
+        c.SessionStore = tempConfig.SessionStore
+        if c.SessionStore.Type == "" {
+            c.SessionStore.Type = SessionStoreMemory
+        }
+        c.Listeners = tempConfig.Listeners
+        if c.Listeners.HTTP.Address == "" {
+            c.Listeners.HTTP.Address = DefaultHTTPAddress
+        }
+        if c.Listeners.SOCKS.Address == "" {
+            c.Listeners.SOCKS.Address = DefaultSOCKSAddress
+        }
+    } else {
+        c.SessionStore.Keys = tempConfig.SessionStore.Keys
+        c.SessionStore.ActiveKey = tempConfig.SessionStore.ActiveKey
     }
+    c.loaded = true
 
-    for {
-        select {
-        case event, ok := <-watcher.Events:
-            if !ok {
-                return
-            }
-            if event.Op&(fsnotify.Write|fsnotify.Create) != 0 && event.Name == c.ConfigPath {
-                c.Logging.Logln("Config file changed, reloading...")
-                c.loadConfig()
-            }
-        case err, ok := <-watcher.Errors:
-            if !ok {
-                return
-            }
-            c.Logging.Logf("Watcher error: %s", err)
+    for _, cred := range c.UserCredentials {
+        if PasswordScheme(cred.Password) == "" {
+            c.Logging.Warn("Password is stored in plaintext, use 'hash-password' to hash it", "user", cred.Username)
         }
     }
+
+    c.Logging.Info("Configuration loaded", "path", c.ConfigPath)
+    return nil
 }
 
 func (c *Config) GetTargetDomain(domainName string) (string, bool) {
@@ -102,13 +321,237 @@ func (c *Config) GetTargetDomain(domainName string) (string, bool) {
     return "", false
 }
 
-func (c *Config) AuthenticateUser(username, password string) bool {
+// GetMapping returns the mapping with the given name
+func (c *Config) GetMapping(domainName string) (DomainMapping, bool) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, mapping := range c.DomainMappings {
+        if mapping.From == domainName {
+            return mapping, true
+        }
+    }
+    return DomainMapping{}, false
+}
+
+// RewriteSOCKSNames reports whether SOCKS5 clients may use mapping names as destinations
+func (c *Config) RewriteSOCKSNames() bool {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.SOCKS.RewriteNames
+}
+
+// GetMaxBodySize returns the maximum size of proxied request and response bodies
+func (c *Config) GetMaxBodySize() int64 {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.MaxBodySize
+}
+
+// GetUpstreamIdleTimeout returns how long an upstream connection may go without
+// sending or accepting data before the request fails
+func (c *Config) GetUpstreamIdleTimeout() time.Duration {
     c.Mutex.RLock()
     defer c.Mutex.RUnlock()
+    return time.Duration(c.UpstreamIdleTimeout)
+}
+
+// GetListeners returns the listener settings of both proxies
+func (c *Config) GetListeners() ListenersConfig {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.Listeners
+}
+
+// OverrideListenAddresses replaces the configured listen addresses, empty values are ignored
+func (c *Config) OverrideListenAddresses(httpAddress, socksAddress, adminAddress string) {
+    c.Mutex.Lock()
+    defer c.Mutex.Unlock()
+    if httpAddress != "" {
+        c.Listeners.HTTP.Address = httpAddress
+    }
+    if socksAddress != "" {
+        c.Listeners.SOCKS.Address = socksAddress
+    }
+    if adminAddress != "" {
+        c.Listeners.Admin.Address = adminAddress
+    }
+}
+
+// GetSessionLimits returns the idle timeout and maximum lifetime of new sessions of a user
+func (c *Config) GetSessionLimits(username string) (idleTimeout, maxLifetime time.Duration) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+
+    idleTimeout = time.Duration(c.SessionIdleTimeout)
+    maxLifetime = time.Duration(c.SessionMaxLifetime)
+    for _, cred := range c.UserCredentials {
+        if cred.Username != username {
+            continue
+        }
+        if cred.SessionIdleTimeout != nil {
+            idleTimeout = time.Duration(*cred.SessionIdleTimeout)
+        }
+        if cred.SessionMaxLifetime != nil {
+            maxLifetime = time.Duration(*cred.SessionMaxLifetime)
+        }
+    }
+    return idleTimeout, maxLifetime
+}
+
+// GetSessionQuota returns how many live sessions a user may have, 0 meaning
+// unlimited, and the policy applied when a handshake exceeds it
+func (c *Config) GetSessionQuota(username string) (maxSessions int, policy string) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+
+    maxSessions = c.MaxSessions
+    policy = c.SessionLimitPolicy
+    for _, cred := range c.UserCredentials {
+        if cred.Username != username {
+            continue
+        }
+        if cred.MaxSessions != nil {
+            maxSessions = *cred.MaxSessions
+        }
+        if cred.SessionLimitPolicy != "" {
+            policy = cred.SessionLimitPolicy
+        }
+    }
+    return maxSessions, policy
+}
+
+// GetBruteForce returns the brute-force protection settings
+func (c *Config) GetBruteForce() BruteForceConfig {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.BruteForce
+}
+
+// GetTrafficLimits returns the traffic limits of a user
+func (c *Config) GetTrafficLimits(username string) TrafficLimits {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, cred := range c.UserCredentials {
+        if cred.Username == username {
+            return cred.Traffic
+        }
+    }
+    return TrafficLimits{}
+}
+
+// GetVisitedLogPrivacy returns how the visited addresses of a user are logged
+func (c *Config) GetVisitedLogPrivacy(username string) logging.Privacy {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+
+    settings := c.Log.Visited
+    privacy := logging.Privacy{
+        Mode:         settings.Mode,
+        RedactParams: settings.RedactQueryParams,
+        HashKey:      []byte(settings.HashKey),
+    }
     for _, cred := range c.UserCredentials {
-        if cred.Username == username && cred.Password == password {
-            return true
+        if cred.Username == username && cred.VisitedLog != "" {
+            privacy.Mode = cred.VisitedLog
         }
     }
+    if privacy.Mode == "" {
+        privacy.Mode = logging.VisitedFull
+    }
+    if privacy.RedactParams == nil {
+        privacy.RedactParams = logging.DefaultRedactedParams
+    }
+    if len(privacy.HashKey) == 0 {
+        privacy.HashKey = c.hashKey
+    }
+    return privacy
+}
+
+// settings converts the config section to the settings of the logging package
+func (l LogConfig) settings() logging.Settings {
+    return logging.Settings{
+        Level:        l.Level,
+        Format:       l.Format,
+        AccessFormat: l.AccessFormat,
+        Rotation: logging.Rotation{
+            MaxSize:    l.Rotation.MaxSize,
+            MaxAge:     time.Duration(l.Rotation.MaxAge),
+            MaxBackups: l.Rotation.MaxBackups,
+            Compress:   l.Rotation.Compress,
+        },
+    }
+}
+
+// GetLog returns the log level, format and rotation
+func (c *Config) GetLog() LogConfig {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.Log
+}
+
+// GetUsageFile returns the path of the traffic usage file
+func (c *Config) GetUsageFile() string {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.UsageFile
+}
+
+// GetSessionStore returns the session store settings
+func (c *Config) GetSessionStore() SessionStoreConfig {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return c.SessionStore
+}
+
+// GetSigningKeys returns the decoded token signing keys by ID and the ID of the active key
+func (c *Config) GetSigningKeys() (map[string][]byte, string) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+
+    keys := make(map[string][]byte, len(c.SessionStore.Keys))
+    for _, key := range c.SessionStore.Keys {
+        // Secrets were checked by validate, a failure here cannot happen
+        secret, _ := base64.StdEncoding.DecodeString(key.Secret)
+        keys[key.ID] = secret
+    }
+    return keys, c.SessionStore.ActiveKey
+}
+
+// GetCleanupInterval returns how often expired sessions are swept
+func (c *Config) GetCleanupInterval() time.Duration {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    return time.Duration(c.CleanupInterval)
+}
+
+func (c *Config) AuthenticateUser(username, password string) bool {
+    // Hashing takes long, so it runs after the lock is released. A waiting
+    // reload would otherwise block every other reader until it finished.
+    stored, found, scheme := c.storedPassword(username)
+    if found {
+        return VerifyPassword(stored, password)
+    }
+
+    // Unknown users pay for a hash check like known ones, the response time
+    // must not reveal which usernames exist
+    if scheme != "" {
+        VerifyPassword(dummyHash(scheme), password)
+    }
     return false
 }
+
+// storedPassword returns the stored password of a user. For unknown users it
+// returns the first hashing scheme in use, to check a dummy hash of the same cost.
+func (c *Config) storedPassword(username string) (stored string, found bool, scheme string) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, cred := range c.UserCredentials {
+        if cred.Username == username {
+            return cred.Password, true, ""
+        }
+        if scheme == "" {
+            scheme = PasswordScheme(cred.Password)
+        }
+    }
+    return "", false, scheme
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// Duration is a time.Duration written in the config as a string such as "90s" or "12h",
+// or as a plain number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var value interface{}
+    if err := json.Unmarshal(data, &value); err != nil {
+        return err
+    }
+
+    switch v := value.(type) {
+    case float64:
+        *d = Duration(time.Duration(v * float64(time.Second)))
+    case string:
+        parsed, err := time.ParseDuration(v)
+        if err != nil {
+            return fmt.Errorf("invalid duration %q", v)
+        }
+        *d = Duration(parsed)
+    default:
+        return fmt.Errorf("invalid duration %s", data)
+    }
+    return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hashing schemes
+const (
+    SchemeBcrypt   = "bcrypt"
+    SchemeArgon2id = "argon2id"
+)
+
+// argon2id parameters used when hashing new passwords
+const (
+    argon2Memory  = 64 * 1024
+    argon2Time    = 3
+    argon2Threads = 4
+    argon2SaltLen = 16
+    argon2KeyLen  = 32
+)
+
+// Limits of stored argon2id parameters. A single login with a larger memory
+// or time cost could exhaust the server, so such hashes are rejected as malformed.
+const (
+    argon2MaxMemory  = 1024 * 1024 // KiB, 1 GiB
+    argon2MaxTime    = 16
+    argon2MaxThreads = 64
+    argon2MaxKeyLen  = 64
+)
+
+var (
+    ErrUnknownScheme     = errors.New("unknown password hashing scheme")
+    ErrMalformedArgon2id = errors.New("malformed argon2id hash")
+)
+
+// HashPassword hashes a plaintext password with the given scheme and returns
+// a string suitable for the "password" field of a user credential
+func HashPassword(password, scheme string) (string, error) {
+    switch scheme {
+    case SchemeBcrypt:
+        hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+        if err != nil {
+            return "", err
+        }
+        return string(hash), nil
+    case SchemeArgon2id:
+        salt := make([]byte, argon2SaltLen)
+        if _, err := rand.Read(salt); err != nil {
+            return "", err
+        }
+        key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+        return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+            argon2.Version, argon2Memory, argon2Time, argon2Threads,
+            base64.RawStdEncoding.EncodeToString(salt),
+            base64.RawStdEncoding.EncodeToString(key)), nil
+    default:
+        return "", ErrUnknownScheme
+    }
+}
+
+// PasswordScheme returns the hashing scheme of a stored password,
+// or an empty string if it is stored in plaintext
+func PasswordScheme(stored string) string {
+    switch {
+    case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+        return SchemeBcrypt
+    case strings.HasPrefix(stored, "$argon2id$"):
+        return SchemeArgon2id
+    default:
+        return ""
+    }
+}
+
+// VerifyPassword checks a plaintext password against a stored value.
+// Hashed values are identified by their prefix, anything else is treated
+// as a legacy plaintext password. All comparisons run in constant time.
+func VerifyPassword(stored, password string) bool {
+    switch PasswordScheme(stored) {
+    case SchemeBcrypt:
+        return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+    case SchemeArgon2id:
+        ok, err := verifyArgon2id(stored, password)
+        return err == nil && ok
+    default:
+        return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+    }
+}
+
+// dummyHashes are verified instead of a stored password when the username is
+// unknown, so that looking up a missing user takes as long as a wrong password
+var dummyHashes = struct {
+    once   sync.Once
+    hashes map[string]string
+}{}
+
+// dummyHash returns a hash of a random password in the given scheme
+func dummyHash(scheme string) string {
+    dummyHashes.once.Do(func() {
+        dummyHashes.hashes = make(map[string]string)
+        password := make([]byte, 16)
+        rand.Read(password)
+        for _, scheme := range []string{SchemeBcrypt, SchemeArgon2id} {
+            if hash, err := HashPassword(base64.RawStdEncoding.EncodeToString(password), scheme); err == nil {
+                dummyHashes.hashes[scheme] = hash
+            }
+        }
+    })
+    return dummyHashes.hashes[scheme]
+}
+
+// argon2idHash holds the parts of a PHC formatted argon2id hash
+type argon2idHash struct {
+    memory  uint32
+    time    uint32
+    threads uint8
+    salt    []byte
+    key     []byte
+}
+
+// parseArgon2id splits a PHC formatted argon2id hash into its parameters
+func parseArgon2id(stored string) (*argon2idHash, error) {
+    // $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+    parts := strings.Split(stored, "$")
+    if len(parts) != 6 {
+        return nil, ErrMalformedArgon2id
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return nil, ErrMalformedArgon2id
+    }
+
+    hash := &argon2idHash{}
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads); err != nil {
+        return nil, ErrMalformedArgon2id
+    }
+    // argon2.IDKey panics on parameters below its minimums
+    if hash.time < 1 || hash.threads < 1 || hash.memory < 8*uint32(hash.threads) {
+        return nil, ErrMalformedArgon2id
+    }
+    if hash.time > argon2MaxTime || hash.threads > argon2MaxThreads || hash.memory > argon2MaxMemory {
+        return nil, ErrMalformedArgon2id
+    }
+
+    var err error
+    if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+        return nil, ErrMalformedArgon2id
+    }
+    if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 || len(hash.key) > argon2MaxKeyLen {
+        return nil, ErrMalformedArgon2id
+    }
+    return hash, nil
+}
+
+// verifyArgon2id parses a PHC formatted argon2id hash and compares it with the password
+func verifyArgon2id(stored, password string) (bool, error) {
+    hash, err := parseArgon2id(stored)
+    if err != nil {
+        return false, err
+    }
+    computed := argon2.IDKey([]byte(password), hash.salt, hash.time, hash.memory, hash.threads, uint32(len(hash.key)))
+    return subtle.ConstantTimeCompare(hash.key, computed) == 1, nil
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+    "encoding/base64"
+    "errors"
+    "testing"
+)
+
+func TestHashAndVerifyPassword(t *testing.T) {
+    for _, scheme := range []string{SchemeBcrypt, SchemeArgon2id} {
+        hash, err := HashPassword("correct horse", scheme)
+        if err != nil {
+            t.Fatalf("%s: HashPassword: %s", scheme, err)
+        }
+        if got := PasswordScheme(hash); got != scheme {
+            t.Errorf("%s: PasswordScheme = %q", scheme, got)
+        }
+        if !VerifyPassword(hash, "correct horse") {
+            t.Errorf("%s: correct password rejected", scheme)
+        }
+        if VerifyPassword(hash, "wrong horse") {
+            t.Errorf("%s: wrong password accepted", scheme)
+        }
+        if err := checkPasswordHash(hash); err != nil {
+            t.Errorf("%s: checkPasswordHash: %s", scheme, err)
+        }
+    }
+}
+
+func TestHashPasswordUnknownScheme(t *testing.T) {
+    if _, err := HashPassword("secret", "md5"); !errors.Is(err, ErrUnknownScheme) {
+        t.Errorf("err = %v, want ErrUnknownScheme", err)
+    }
+}
+
+func TestVerifyPlaintextPassword(t *testing.T) {
+    if !VerifyPassword("secret", "secret") {
+        t.Error("matching plaintext password rejected")
+    }
+    if VerifyPassword("secret", "Secret") {
+        t.Error("different plaintext password accepted")
+    }
+}
+
+func TestParseArgon2idRejectsBadParameters(t *testing.T) {
+    const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+    for _, params := range []string{
+        "m=65536,t=0,p=4", // argon2 panics on zero rounds
+        "m=65536,t=3,p=0", // and on zero threads
+        "m=16,t=3,p=4",    // and on less than 8 KiB of memory per thread
+        "m=65536,t=3",
+        "m=4000000000,t=3,p=4", // one login would try to allocate about 4 TiB
+        "m=1048577,t=3,p=4",
+        "m=65536,t=17,p=4",
+        "m=65536,t=3,p=65",
+    } {
+        stored := "$argon2id$v=19$" + params + "$" + salt + "$" + key
+        if _, err := parseArgon2id(stored); !errors.Is(err, ErrMalformedArgon2id) {
+            t.Errorf("%s: err = %v, want ErrMalformedArgon2id", params, err)
+        }
+        if err := checkPasswordHash(stored); err == nil {
+            t.Errorf("%s: checkPasswordHash accepted the hash", params)
+        }
+        if VerifyPassword(stored, "secret") {
+            t.Errorf("%s: VerifyPassword accepted the password", params)
+        }
+    }
+
+    for _, stored := range []string{
+        "$argon2id$v=18$m=65536,t=3,p=4$" + salt + "$" + key,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$",
+        "$argon2id$v=19$m=65536,t=3,p=4$!!$" + key,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)),
+    } {
+        if _, err := parseArgon2id(stored); !errors.Is(err, ErrMalformedArgon2id) {
+            t.Errorf("%s: err = %v, want ErrMalformedArgon2id", stored, err)
+        }
+    }
+}
+
+func TestAuthenticateUser(t *testing.T) {
+    hash, err := HashPassword("secret", SchemeBcrypt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := &Config{UserCredentials: []UserCredential{{Username: "alice", Password: hash}}}
+
+    if !c.AuthenticateUser("alice", "secret") {
+        t.Error("correct password rejected")
+    }
+    if c.AuthenticateUser("alice", "wrong") {
+        t.Error("wrong password accepted")
+    }
+    if c.AuthenticateUser("bob", "secret") {
+        t.Error("unknown user accepted")
+    }
+}
+
+func TestParseArgon2idAcceptsLimits(t *testing.T) {
+    const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+    stored := "$argon2id$v=19$m=1048576,t=16,p=64$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 64))
+    if _, err := parseArgon2id(stored); err != nil {
+        t.Errorf("parameters at the limits rejected: %s", err)
+    }
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+)
+
+// isDomainAllowed applies the allow/deny lists of a credential to a mapping name.
+// Deny entries take precedence, an empty allow list permits every mapping.
+func (cred *UserCredential) isDomainAllowed(domainName string) bool {
+    if matchesAny(cred.DeniedDomains, domainName) {
+        return false
+    }
+    if len(cred.AllowedDomains) == 0 {
+        return true
+    }
+    return matchesAny(cred.AllowedDomains, domainName)
+}
+
+// matchesAny reports whether the name matches one of the names or glob patterns
+func matchesAny(patterns []string, name string) bool {
+    for _, pattern := range patterns {
+        if pattern == name {
+            return true
+        }
+        if ok, err := path.Match(pattern, name); err == nil && ok {
+            return true
+        }
+    }
+    return false
+}
+
+// AuthorizeDomain reports whether the user may open sessions for the mapping name
+func (c *Config) AuthorizeDomain(username, domainName string) bool {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for i := range c.UserCredentials {
+        if c.UserCredentials[i].Username == username {
+            return c.UserCredentials[i].isDomainAllowed(domainName)
+        }
+    }
+    return false
+}
+
+// HasUser reports whether a user with the given name is configured
+func (c *Config) HasUser(username string) bool {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, cred := range c.UserCredentials {
+        if cred.Username == username {
+            return true
+        }
+    }
+    return false
+}
+
+// IsAdmin reports whether a configured user has admin rights
+func (c *Config) IsAdmin(username string) bool {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, cred := range c.UserCredentials {
+        if cred.Username == username {
+            return cred.Admin
+        }
+    }
+    return false
+}
+
+// GetMappingForHost finds the mapping whose target host equals the host. The
+// mapping name only matches when SOCKS5 name rewriting is enabled, otherwise a
+// short name like "github" would reach the system resolver and its search domains.
+func (c *Config) GetMappingForHost(host string) (DomainMapping, bool) {
+    c.Mutex.RLock()
+    defer c.Mutex.RUnlock()
+    for _, mapping := range c.DomainMappings {
+        if (c.SOCKS.RewriteNames && strings.EqualFold(mapping.From, host)) || strings.EqualFold(mapping.Host(), host) {
+            return mapping, true
+        }
+    }
+    return DomainMapping{}, false
+}
+
+// Host extracts the host name from the mapping's target URL
+func (m DomainMapping) Host() string {
+    u, err := url.Parse(m.To)
+    if err != nil || u.Host == "" {
+        return m.To
+    }
+    return u.Hostname()
+}
+
+// Port returns the port of the mapping's target URL, the scheme's default if
+// none is given, or 0 if the URL cannot be parsed
+func (m DomainMapping) Port() int {
+    u, err := url.Parse(m.To)
+    if err != nil {
+        return 0
+    }
+    if port, err := strconv.Atoi(u.Port()); err == nil {
+        return port
+    }
+    switch u.Scheme {
+    case "http":
+        return 80
+    case "https":
+        return 443
+    }
+    return 0
+}
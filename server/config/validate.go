@@ -0,0 +1,464 @@
+package config
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "path"
+    "reflect"
+    "sort"
+    "strings"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// fileConfig is the on-disk layout of config.json
+type fileConfig struct {
+    UserCredentials []UserCredential `json:"user_credentials"`
+    DomainMappings  []DomainMapping  `json:"domain_mappings"`
+    SOCKS           SOCKSConfig      `json:"socks"`
+    MaxBodySize     int64            `json:"max_body_size"`
+    Listeners       ListenersConfig  `json:"listeners"`
+
+    UpstreamIdleTimeout Duration `json:"upstream_idle_timeout"`
+
+    SessionIdleTimeout Duration `json:"session_idle_timeout"`
+    SessionMaxLifetime Duration `json:"session_max_lifetime"`
+    CleanupInterval    Duration `json:"cleanup_interval"`
+
+    MaxSessions        int    `json:"max_sessions"`
+    SessionLimitPolicy string `json:"session_limit_policy"`
+
+    SessionStore SessionStoreConfig `json:"session_store"`
+    BruteForce   BruteForceConfig   `json:"brute_force"`
+    UsageFile    string             `json:"usage_file"`
+    Log          LogConfig          `json:"logging"`
+}
+
+// ValidationError describes one problem in the config file
+type ValidationError struct {
+    Path    string // JSON path of the offending value, e.g. user_credentials[1].password
+    Message string
+}
+
+func (e ValidationError) Error() string {
+    return e.Path + ": " + e.Message
+}
+
+// ValidationErrors collects every problem found in a config file
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+    lines := make([]string, len(e))
+    for i, err := range e {
+        lines[i] = "  " + err.Error()
+    }
+    return fmt.Sprintf("%d problem(s) in config:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e *ValidationErrors) add(path, format string, v ...interface{}) {
+    *e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, v...)})
+}
+
+// CheckConfig reads and validates a config file without applying it
+func CheckConfig(path string) error {
+    _, err := readConfigFile(path)
+    return err
+}
+
+// readConfigFile parses and validates a config file. Invalid files
+// return ValidationErrors listing all problems at once.
+func readConfigFile(path string) (*fileConfig, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config file: %w", err)
+    }
+
+    // The generic tree keeps numbers as written, so large integers survive re-encoding
+    var raw interface{}
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    if err := decoder.Decode(&raw); err != nil {
+        return nil, fmt.Errorf("failed to parse config: %w", err)
+    }
+    if _, ok := raw.(map[string]interface{}); !ok {
+        return nil, fmt.Errorf("failed to parse config: expected a JSON object, got JSON %s", jsonKind(raw))
+    }
+
+    // Values of the wrong type are reported and dropped from the tree, so the
+    // rest of the file is still decoded and validated
+    var problems ValidationErrors
+    checkValue(raw, reflect.TypeOf(fileConfig{}), "", &problems)
+    cleaned, err := json.Marshal(raw)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse config: %w", err)
+    }
+
+    parsed := &fileConfig{}
+    if err := json.Unmarshal(cleaned, parsed); err != nil {
+        return nil, fmt.Errorf("failed to parse config: %w", err)
+    }
+
+    parsed.validate(&problems)
+    if len(problems) > 0 {
+        return nil, problems
+    }
+    return parsed, nil
+}
+
+// validate checks the values of a parsed config
+func (f *fileConfig) validate(problems *ValidationErrors) {
+    usernames := make(map[string]int)
+    for i, cred := range f.UserCredentials {
+        prefix := fmt.Sprintf("user_credentials[%d]", i)
+        if cred.Username == "" {
+            problems.add(prefix+".username", "must not be empty")
+        } else if first, exists := usernames[cred.Username]; exists {
+            problems.add(prefix+".username", "duplicate username '%s', first defined at user_credentials[%d]", cred.Username, first)
+        } else {
+            usernames[cred.Username] = i
+        }
+
+        if cred.Password == "" {
+            problems.add(prefix+".password", "must not be empty")
+        } else if err := checkPasswordHash(cred.Password); err != nil {
+            problems.add(prefix+".password", "%s", err)
+        }
+
+        checkPatterns(cred.AllowedDomains, prefix+".allowed_domains", problems)
+        checkPatterns(cred.DeniedDomains, prefix+".denied_domains", problems)
+
+        if cred.SessionIdleTimeout != nil && *cred.SessionIdleTimeout < 0 {
+            problems.add(prefix+".session_idle_timeout", "must not be negative")
+        }
+        if cred.SessionMaxLifetime != nil && *cred.SessionMaxLifetime < 0 {
+            problems.add(prefix+".session_max_lifetime", "must not be negative")
+        }
+        f.checkSessionQuota(cred.MaxSessions, cred.SessionLimitPolicy, prefix+".", problems)
+        checkTrafficLimits(cred.Traffic, prefix+".traffic", problems)
+        checkVisitedMode(cred.VisitedLog, prefix+".visited_log", problems)
+    }
+
+    names := make(map[string]int)
+    for i, mapping := range f.DomainMappings {
+        prefix := fmt.Sprintf("domain_mappings[%d]", i)
+        if mapping.From == "" {
+            problems.add(prefix+".from", "must not be empty")
+        } else if first, exists := names[mapping.From]; exists {
+            problems.add(prefix+".from", "duplicate mapping name '%s', first defined at domain_mappings[%d]", mapping.From, first)
+        } else {
+            names[mapping.From] = i
+        }
+
+        target, err := url.Parse(mapping.To)
+        switch {
+        case err != nil:
+            problems.add(prefix+".to", "malformed URL: %s", err)
+        case target.Scheme != "http" && target.Scheme != "https":
+            problems.add(prefix+".to", "URL scheme must be http or https, got '%s'", mapping.To)
+        case target.Host == "":
+            problems.add(prefix+".to", "URL has no host: '%s'", mapping.To)
+        }
+
+        if fingerprint := mapping.TLS.PinnedSHA256; fingerprint != "" {
+            decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+            if err != nil || len(decoded) != 32 {
+                problems.add(prefix+".tls.pinned_sha256", "must be a hex encoded SHA-256 fingerprint")
+            }
+        }
+    }
+
+    if f.MaxBodySize < 0 {
+        problems.add("max_body_size", "must not be negative")
+    }
+    if f.UpstreamIdleTimeout < 0 {
+        problems.add("upstream_idle_timeout", "must not be negative")
+    }
+    if f.SessionIdleTimeout < 0 {
+        problems.add("session_idle_timeout", "must not be negative")
+    }
+    if f.SessionMaxLifetime < 0 {
+        problems.add("session_max_lifetime", "must not be negative")
+    }
+    if f.CleanupInterval < 0 {
+        problems.add("cleanup_interval", "must not be negative")
+    }
+
+    maxSessions := f.MaxSessions
+    f.checkSessionQuota(&maxSessions, f.SessionLimitPolicy, "", problems)
+
+    switch f.SessionStore.Type {
+    case "", SessionStoreMemory:
+    case SessionStoreFile:
+        if f.SessionStore.Path == "" {
+            problems.add("session_store.path", "must be set for the file session store")
+        }
+    case SessionStoreSigned:
+        f.validateSigningKeys(problems)
+    default:
+        problems.add("session_store.type", "unknown session store '%s', expected memory, file or signed", f.SessionStore.Type)
+    }
+
+    if f.BruteForce.MaxAttemptsPerIP < 0 {
+        problems.add("brute_force.max_attempts_per_ip", "must not be negative")
+    }
+    if f.BruteForce.MaxAttemptsPerUser < 0 {
+        problems.add("brute_force.max_attempts_per_user", "must not be negative")
+    }
+    if f.BruteForce.Window < 0 {
+        problems.add("brute_force.window", "must not be negative")
+    }
+    if f.BruteForce.Lockout < 0 {
+        problems.add("brute_force.lockout", "must not be negative")
+    }
+    if f.BruteForce.MaxLockout < 0 {
+        problems.add("brute_force.max_lockout", "must not be negative")
+    } else if f.BruteForce.MaxLockout > 0 && f.BruteForce.MaxLockout < f.BruteForce.Lockout {
+        problems.add("brute_force.max_lockout", "must not be shorter than lockout")
+    }
+
+    if _, err := logging.ParseLevel(f.Log.Level); err != nil {
+        problems.add("logging.level", "unknown level '%s', expected debug, info, warn or error", f.Log.Level)
+    }
+    switch f.Log.Format {
+    case "", logging.FormatText, logging.FormatJSON:
+    default:
+        problems.add("logging.format", "unknown format '%s', expected text or json", f.Log.Format)
+    }
+    if _, err := logging.ParseAccessFormat(f.Log.AccessFormat); err != nil {
+        problems.add("logging.access_format", "unknown format '%s', expected json, common or combined", f.Log.AccessFormat)
+    }
+    checkVisitedMode(f.Log.Visited.Mode, "logging.visited.mode", problems)
+    checkPatterns(f.Log.Visited.RedactQueryParams, "logging.visited.redact_query_params", problems)
+    if f.Log.Rotation.MaxSize < 0 {
+        problems.add("logging.rotation.max_size", "must not be negative")
+    }
+    if f.Log.Rotation.MaxAge < 0 {
+        problems.add("logging.rotation.max_age", "must not be negative")
+    }
+    if f.Log.Rotation.MaxBackups < 0 {
+        problems.add("logging.rotation.max_backups", "must not be negative")
+    }
+
+    if tls := f.Listeners.HTTP.TLS; (tls.CertFile == "") != (tls.KeyFile == "") {
+        problems.add("listeners.http.tls", "cert_file and key_file must be set together")
+    }
+    if f.Listeners.SOCKS.TLS.Enabled() {
+        problems.add("listeners.socks.tls", "TLS is only supported on the HTTP listener")
+    }
+    if f.Listeners.Admin.TLS.Enabled() {
+        problems.add("listeners.admin.tls", "TLS is only supported on the HTTP listener")
+    }
+}
+
+// checkSessionQuota checks a global or per-user concurrent session limit
+func (f *fileConfig) checkSessionQuota(maxSessions *int, policy, prefix string, problems *ValidationErrors) {
+    if maxSessions != nil {
+        switch {
+        case *maxSessions < 0:
+            problems.add(prefix+"max_sessions", "must not be negative")
+        case *maxSessions > 0 && f.SessionStore.Type == SessionStoreSigned:
+            // Signed tokens are not tracked, so live sessions cannot be counted
+            problems.add(prefix+"max_sessions", "is not supported by the signed session store")
+        }
+    }
+
+    switch policy {
+    case "", SessionLimitReject, SessionLimitEvictOldest:
+    default:
+        problems.add(prefix+"session_limit_policy", "unknown policy '%s', expected reject or evict_oldest", policy)
+    }
+}
+
+// checkTrafficLimits rejects negative traffic limits
+func checkTrafficLimits(limits TrafficLimits, prefix string, problems *ValidationErrors) {
+    if limits.RequestsPerSecond < 0 {
+        problems.add(prefix+".requests_per_second", "must not be negative")
+    }
+    if limits.SessionRequestsPerSecond < 0 {
+        problems.add(prefix+".session_requests_per_second", "must not be negative")
+    }
+    if limits.Burst < 0 {
+        problems.add(prefix+".burst", "must not be negative")
+    }
+    if limits.BytesPerSecond < 0 {
+        problems.add(prefix+".bytes_per_second", "must not be negative")
+    }
+    if limits.DailyBytes < 0 {
+        problems.add(prefix+".daily_bytes", "must not be negative")
+    }
+    if limits.MonthlyBytes < 0 {
+        problems.add(prefix+".monthly_bytes", "must not be negative")
+    }
+}
+
+// minSigningKeyLength is the minimum decoded length of a token signing secret
+const minSigningKeyLength = 32
+
+// validateSigningKeys checks the keys of the signed session store
+func (f *fileConfig) validateSigningKeys(problems *ValidationErrors) {
+    if len(f.SessionStore.Keys) == 0 {
+        problems.add("session_store.keys", "at least one key is required for the signed session store")
+        return
+    }
+
+    ids := make(map[string]int)
+    for i, key := range f.SessionStore.Keys {
+        prefix := fmt.Sprintf("session_store.keys[%d]", i)
+        switch {
+        case key.ID == "":
+            problems.add(prefix+".id", "must not be empty")
+        case strings.Contains(key.ID, "."):
+            problems.add(prefix+".id", "must not contain '.'")
+        default:
+            if first, exists := ids[key.ID]; exists {
+                problems.add(prefix+".id", "duplicate key id '%s', first defined at session_store.keys[%d]", key.ID, first)
+            }
+            ids[key.ID] = i
+        }
+
+        secret, err := base64.StdEncoding.DecodeString(key.Secret)
+        if err != nil {
+            problems.add(prefix+".secret", "must be base64 encoded")
+        } else if len(secret) < minSigningKeyLength {
+            problems.add(prefix+".secret", "must be at least %d bytes long", minSigningKeyLength)
+        }
+    }
+
+    if _, exists := ids[f.SessionStore.ActiveKey]; !exists {
+        problems.add("session_store.active_key", "must name one of the keys")
+    }
+}
+
+// checkPasswordHash rejects hashed passwords that cannot be verified
+func checkPasswordHash(stored string) error {
+    switch PasswordScheme(stored) {
+    case SchemeBcrypt:
+        if _, err := bcrypt.Cost([]byte(stored)); err != nil {
+            return fmt.Errorf("malformed bcrypt hash: %s", err)
+        }
+    case SchemeArgon2id:
+        if _, err := parseArgon2id(stored); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// checkVisitedMode rejects unknown ways of logging visited addresses, empty inherits
+func checkVisitedMode(mode string, prefix string, problems *ValidationErrors) {
+    switch mode {
+    case "", logging.VisitedFull, logging.VisitedHost, logging.VisitedHashed, logging.VisitedNone:
+    default:
+        problems.add(prefix, "unknown mode '%s', expected full, host, hashed or none", mode)
+    }
+}
+
+// checkPatterns rejects malformed glob patterns in a domain or parameter list
+func checkPatterns(patterns []string, prefix string, problems *ValidationErrors) {
+    for i, pattern := range patterns {
+        if _, err := path.Match(pattern, ""); err != nil {
+            problems.add(fmt.Sprintf("%s[%d]", prefix, i), "malformed pattern '%s'", pattern)
+        }
+    }
+}
+
+// checkValue reports unknown keys and values that cannot be decoded into the
+// given type, each with its JSON path. It returns false if raw itself cannot be
+// decoded, the caller then drops it from the tree.
+func checkValue(raw interface{}, t reflect.Type, prefix string, problems *ValidationErrors) bool {
+    if raw == nil {
+        return true
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        return checkValue(raw, t.Elem(), prefix, problems)
+    case reflect.Slice:
+        items, ok := raw.([]interface{})
+        if !ok {
+            problems.add(prefix, "expected an array, got JSON %s", jsonKind(raw))
+            return false
+        }
+        for i, item := range items {
+            // Dropped items become null, the following items keep their index
+            if !checkValue(item, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i), problems) {
+                items[i] = nil
+            }
+        }
+        return true
+    case reflect.Struct:
+        object, ok := raw.(map[string]interface{})
+        if !ok {
+            problems.add(prefix, "expected an object, got JSON %s", jsonKind(raw))
+            return false
+        }
+
+        fields := make(map[string]reflect.Type)
+        for i := 0; i < t.NumField(); i++ {
+            name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+            if name != "" && name != "-" {
+                fields[name] = t.Field(i).Type
+            }
+        }
+
+        keys := make([]string, 0, len(object))
+        for key := range object {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+
+        for _, key := range keys {
+            keyPath := key
+            if prefix != "" {
+                keyPath = prefix + "." + key
+            }
+            fieldType, known := fields[key]
+            if !known {
+                problems.add(keyPath, "unknown key")
+                continue
+            }
+            if !checkValue(object[key], fieldType, keyPath, problems) {
+                delete(object, key)
+            }
+        }
+        return true
+    }
+
+    // Everything else is a single value, decoding it alone also runs Duration's parser
+    data, err := json.Marshal(raw)
+    if err == nil {
+        err = json.Unmarshal(data, reflect.New(t).Interface())
+    }
+    if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+        problems.add(prefix, "expected %s, got JSON %s", typeErr.Type, typeErr.Value)
+        return false
+    }
+    if err != nil {
+        problems.add(prefix, "%s", err)
+        return false
+    }
+    return true
+}
+
+// jsonKind names the JSON type of a value decoded into an interface{}
+func jsonKind(raw interface{}) string {
+    switch raw.(type) {
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    case string:
+        return "string"
+    case json.Number, float64:
+        return "number"
+    case bool:
+        return "bool"
+    }
+    return "null"
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+const validConfig = `{
+    "user_credentials": [{"username": "alice", "password": "secret"}],
+    "domain_mappings": [{"from": "github", "to": "https://github.com"}],
+    "session_idle_timeout": "1m"
+}`
+
+// writeConfigFile writes a config file into a temporary directory and returns its path
+func writeConfigFile(t *testing.T, content string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestCheckConfigAcceptsValidConfig(t *testing.T) {
+    if err := CheckConfig(writeConfigFile(t, validConfig)); err != nil {
+        t.Errorf("CheckConfig: %s", err)
+    }
+}
+
+func TestCheckConfigReportsEveryProblem(t *testing.T) {
+    err := CheckConfig(writeConfigFile(t, `{
+        "user_credentials": [
+            {"username": "alice", "password": "secret"},
+            {"username": "alice", "password": ""},
+            {"username": "bob", "password": "$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5", "allowed_domains": ["[git"]}
+        ],
+        "domain_mappings": [
+            {"from": "github", "to": "ftp://github.com"},
+            {"from": "github", "to": "https://"}
+        ],
+        "max_body_size": -1,
+        "session_idle_timeout": "-1m",
+        "session_store": {"type": "signed"},
+        "logging": {"level": "loud"},
+        "unknown_key": true
+    }`))
+
+    var problems ValidationErrors
+    if !errors.As(err, &problems) {
+        t.Fatalf("err = %v, want ValidationErrors", err)
+    }
+    var paths []string
+    for _, problem := range problems {
+        paths = append(paths, problem.Path)
+    }
+    sort.Strings(paths)
+
+    for _, want := range []string{
+        "unknown_key",
+        "user_credentials[1].username",
+        "user_credentials[1].password",
+        "user_credentials[2].password",
+        "user_credentials[2].allowed_domains[0]",
+        "domain_mappings[0].to",
+        "domain_mappings[1].from",
+        "domain_mappings[1].to",
+        "max_body_size",
+        "session_idle_timeout",
+        "session_store.keys",
+        "logging.level",
+    } {
+        if i := sort.SearchStrings(paths, want); i == len(paths) || paths[i] != want {
+            t.Errorf("no problem reported at %s, got %v", want, paths)
+        }
+    }
+}
+
+func TestCheckConfigRejectsWrongTypes(t *testing.T) {
+    err := CheckConfig(writeConfigFile(t, `{"max_body_size": "large"}`))
+    var problems ValidationErrors
+    if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != "max_body_size" {
+        t.Errorf("err = %v, want a type problem at max_body_size", err)
+    }
+}
+
+func TestInvalidReloadKeepsActiveConfig(t *testing.T) {
+    path := writeConfigFile(t, validConfig)
+    cfg, err := LoadConfig(path, logging.New(false))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := os.WriteFile(path, []byte(`{"domain_mappings": [{"from": "", "to": "https://example.com"}]}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := cfg.loadConfig(); err == nil {
+        t.Fatal("invalid config was applied")
+    }
+    if _, exists := cfg.GetMapping("github"); !exists {
+        t.Error("the active mappings were replaced by an invalid reload")
+    }
+    if !cfg.AuthenticateUser("alice", "secret") {
+        t.Error("the active users were replaced by an invalid reload")
+    }
+}
+
+func TestCheckConfigKeepsValidatingAfterBadValues(t *testing.T) {
+    err := CheckConfig(writeConfigFile(t, `{
+        "user_credentials": [
+            {"username": "alice", "password": "", "session_idle_timeout": "abc"},
+            "bob"
+        ],
+        "domain_mappings": [{"from": "github", "to": "ftp://github.com"}],
+        "max_body_size": "large",
+        "session_idle_timeout": "abc",
+        "cleanup_interval": true,
+        "unknown_key": true
+    }`))
+
+    var problems ValidationErrors
+    if !errors.As(err, &problems) {
+        t.Fatalf("err = %v, want ValidationErrors", err)
+    }
+    messages := make(map[string]string)
+    for _, problem := range problems {
+        messages[problem.Path] = problem.Message
+    }
+    for path, want := range map[string]string{
+        "user_credentials[0].password":             "must not be empty",
+        "user_credentials[0].session_idle_timeout": `invalid duration "abc"`,
+        "user_credentials[1]":                      "expected an object, got JSON string",
+        "domain_mappings[0].to":                    "URL scheme must be http or https, got 'ftp://github.com'",
+        "max_body_size":                            "expected int64, got JSON string",
+        "session_idle_timeout":                     `invalid duration "abc"`,
+        "cleanup_interval":                         "invalid duration true",
+        "unknown_key":                              "unknown key",
+    } {
+        if messages[path] != want {
+            t.Errorf("%s: got %q, want %q", path, messages[path], want)
+        }
+    }
+}
+
+func TestCheckConfigKeepsLargeNumbers(t *testing.T) {
+    cfg, err := readConfigFile(writeConfigFile(t, `{
+        "user_credentials": [{"username": "alice", "password": "secret"}],
+        "max_body_size": 9007199254740993
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.MaxBodySize != 9007199254740993 {
+        t.Errorf("max_body_size = %d, want 9007199254740993", cfg.MaxBodySize)
+    }
+}
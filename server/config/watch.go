@@ -0,0 +1,97 @@
+package config
+
+import (
+    "path/filepath"
+    "time"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce is how long the watcher waits for a burst of file events
+// (editors often truncate, write and rename in quick succession) to settle.
+const reloadDebounce = 250 * time.Millisecond
+
+// Subscribe returns a channel that receives a value after every successful reload.
+// The channel is buffered, a slow subscriber only misses intermediate notifications.
+func (c *Config) Subscribe() <-chan struct{} {
+    c.subscribersLock.Lock()
+    defer c.subscribersLock.Unlock()
+    ch := make(chan struct{}, 1)
+    c.subscribers = append(c.subscribers, ch)
+    return ch
+}
+
+// notifySubscribers signals every subscriber without blocking
+func (c *Config) notifySubscribers() {
+    c.subscribersLock.Lock()
+    defer c.subscribersLock.Unlock()
+    for _, ch := range c.subscribers {
+        select {
+        case ch <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// WatchConfig reloads the config file when it changes, until done is closed.
+// The parent directory is watched so that files replaced by rename, removed
+// and recreated, or edited from another directory are all picked up.
+func (c *Config) WatchConfig(done <-chan struct{}) {
+    configPath, err := filepath.Abs(c.ConfigPath)
+    if err != nil {
+        c.Logging.Error("Failed to resolve config path, hot reload disabled", "error", err)
+        return
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        c.Logging.Error("Failed to create file watcher, hot reload disabled", "error", err)
+        return
+    }
+    defer watcher.Close()
+
+    if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+        c.Logging.Error("Failed to watch config directory, hot reload disabled", "error", err)
+        return
+    }
+
+    // The timer is only armed while events are pending
+    debounce := time.NewTimer(reloadDebounce)
+    debounce.Stop()
+    defer debounce.Stop()
+
+    for {
+        select {
+        case <-done:
+            return
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return
+            }
+            eventPath, err := filepath.Abs(event.Name)
+            if err != nil || eventPath != configPath {
+                continue
+            }
+            if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+                c.Logging.Warn("Config file was removed or renamed, waiting for it to reappear", "path", c.ConfigPath)
+            }
+            debounce.Reset(reloadDebounce)
+        case <-debounce.C:
+            c.Logging.Info("Config file changed, reloading", "path", c.ConfigPath)
+            err := c.loadConfig()
+            if c.OnReload != nil {
+                c.OnReload(err)
+            }
+            if err != nil {
+                c.Logging.Error("Rejected config reload, keeping the previous configuration", "error", err)
+                continue
+            }
+            c.notifySubscribers()
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return
+            }
+            c.Logging.Error("Watcher error", "error", err)
+        }
+    }
+}
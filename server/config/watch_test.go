@@ -0,0 +1,143 @@
+package config
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+// watchedConfig returns a config mapping github to target
+func watchedConfig(target string) string {
+    return fmt.Sprintf(`{
+        "user_credentials": [{"username": "alice", "password": "secret"}],
+        "domain_mappings": [{"from": "github", "to": %q}],
+        "logging": {"level": "error"}
+    }`, target)
+}
+
+// startWatching loads the config at path and watches it until the test ends.
+// The returned channel receives the result of every reload.
+func startWatching(t *testing.T, path string) (*Config, <-chan error) {
+    t.Helper()
+    cfg, err := LoadConfig(path, logging.New(false))
+    if err != nil {
+        t.Fatal(err)
+    }
+    reloads := make(chan error, 16)
+    cfg.OnReload = func(err error) { reloads <- err }
+
+    done := make(chan struct{})
+    t.Cleanup(func() { close(done) })
+    go cfg.WatchConfig(done)
+    // Give the watcher time to register the directory
+    time.Sleep(100 * time.Millisecond)
+    return cfg, reloads
+}
+
+// waitForReload fails the test unless a reload happens soon
+func waitForReload(t *testing.T, reloads <-chan error) error {
+    t.Helper()
+    select {
+    case err := <-reloads:
+        return err
+    case <-time.After(2 * time.Second):
+        t.Fatal("config was not reloaded")
+        return nil
+    }
+}
+
+// expectNoReload fails the test if a reload happens within twice the debounce delay
+func expectNoReload(t *testing.T, reloads <-chan error) {
+    t.Helper()
+    select {
+    case err := <-reloads:
+        t.Errorf("unexpected reload, err = %v", err)
+    case <-time.After(2 * reloadDebounce):
+    }
+}
+
+func TestWatchConfigDebouncesBursts(t *testing.T) {
+    path := writeConfigFile(t, watchedConfig("https://github.com"))
+    cfg, reloads := startWatching(t, path)
+    changes := cfg.Subscribe()
+
+    // An editor writing the file in several steps causes a single reload
+    for i := 1; i <= 5; i++ {
+        if err := os.WriteFile(path, []byte(watchedConfig(fmt.Sprintf("https://example.com/%d", i))), 0600); err != nil {
+            t.Fatal(err)
+        }
+        time.Sleep(reloadDebounce / 10)
+    }
+    if err := waitForReload(t, reloads); err != nil {
+        t.Fatalf("reload failed: %s", err)
+    }
+    expectNoReload(t, reloads)
+
+    if mapping, _ := cfg.GetMapping("github"); mapping.To != "https://example.com/5" {
+        t.Errorf("mapping = %q, want the last write", mapping.To)
+    }
+    select {
+    case <-changes:
+    default:
+        t.Error("subscriber not notified of the reload")
+    }
+}
+
+func TestWatchConfigFollowsAtomicSaves(t *testing.T) {
+    path := writeConfigFile(t, watchedConfig("https://github.com"))
+    cfg, reloads := startWatching(t, path)
+
+    // Editors save by writing a new file and renaming it over the old one,
+    // the watch has to survive the file being replaced every time
+    for i := 1; i <= 2; i++ {
+        target := fmt.Sprintf("https://example.com/%d", i)
+        tmp := filepath.Join(filepath.Dir(path), ".config.json.swp")
+        if err := os.WriteFile(tmp, []byte(watchedConfig(target)), 0600); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Rename(tmp, path); err != nil {
+            t.Fatal(err)
+        }
+        if err := waitForReload(t, reloads); err != nil {
+            t.Fatalf("reload failed: %s", err)
+        }
+        if mapping, _ := cfg.GetMapping("github"); mapping.To != target {
+            t.Errorf("save %d: mapping = %q, want %q", i, mapping.To, target)
+        }
+    }
+}
+
+func TestWatchConfigIgnoresOtherFiles(t *testing.T) {
+    path := writeConfigFile(t, watchedConfig("https://github.com"))
+    _, reloads := startWatching(t, path)
+
+    if err := os.WriteFile(filepath.Join(filepath.Dir(path), "other.json"), []byte("{}"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    expectNoReload(t, reloads)
+}
+
+func TestWatchConfigRejectsInvalidChanges(t *testing.T) {
+    path := writeConfigFile(t, watchedConfig("https://github.com"))
+    cfg, reloads := startWatching(t, path)
+    changes := cfg.Subscribe()
+
+    if err := os.WriteFile(path, []byte(`{"domain_mappings": [{"from": "", "to": "https://example.com"}]}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := waitForReload(t, reloads); err == nil {
+        t.Fatal("invalid config reloaded without error")
+    }
+    select {
+    case <-changes:
+        t.Error("subscriber notified of a rejected reload")
+    default:
+    }
+    if mapping, _ := cfg.GetMapping("github"); mapping.To != "https://github.com" {
+        t.Errorf("mapping = %q, want the previous config kept", mapping.To)
+    }
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "golang.org/x/term"
+)
+
+// runHashPassword implements the hash-password subcommand.
+// The password is read from stdin so it never appears in shell history.
+func runHashPassword(args []string) int {
+    flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+    scheme := flags.String("scheme", config.SchemeArgon2id, "hashing scheme: argon2id or bcrypt")
+    flags.Parse(args)
+
+    fmt.Fprint(os.Stderr, "Password: ")
+    password, err := readPassword()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to read password: %s\n", err)
+        return 1
+    }
+    if password == "" {
+        fmt.Fprintln(os.Stderr, "Password must not be empty")
+        return 1
+    }
+
+    hash, err := config.HashPassword(password, *scheme)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to hash password: %s\n", err)
+        return 1
+    }
+    fmt.Println(hash)
+    return 0
+}
+
+// readPassword reads one line from stdin, without echoing it when stdin is a terminal
+func readPassword() (string, error) {
+    if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+        password, err := term.ReadPassword(fd)
+        fmt.Fprintln(os.Stderr)
+        return string(password), err
+    }
+
+    password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && password == "" {
+        return "", err
+    }
+    return strings.TrimRight(password, "\r\n"), nil
+}
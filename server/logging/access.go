@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the access log in visited.log
+const (
+	AccessFormatJSON     = "json"
+	AccessFormatCommon   = "common"   // Common Log Format
+	AccessFormatCombined = "combined" // Combined Log Format, CLF with referer and user agent
+)
+
+// clfTimeLayout is the timestamp layout of the Common Log Format
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// AccessEntry is one proxied HTTP request or SOCKS5 connection in visited.log.
+// SOCKS5 connections use the CONNECT method, host:port as the target and an
+// HTTP status code describing the outcome.
+type AccessEntry struct {
+	Time      time.Time
+	User      string
+	Session   string
+	ClientIP  string
+	Mapping   string
+	Method    string
+	Target    string // Full URL, or host:port for SOCKS5
+	Protocol  string // e.g. HTTP/1.1 or SOCKS5
+	Status    int
+	BytesIn   int64 // Received from the client
+	BytesOut  int64 // Sent to the client
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+}
+
+// jsonAccessEntry is the JSON line of an AccessEntry
+type jsonAccessEntry struct {
+	Time       string  `json:"time"`
+	User       string  `json:"user,omitempty"`
+	Session    string  `json:"session,omitempty"`
+	ClientIP   string  `json:"client_ip"`
+	Mapping    string  `json:"mapping,omitempty"`
+	Method     string  `json:"method"`
+	Target     string  `json:"target"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	DurationMS float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+// Access writes an entry to visited.log in the configured access log format.
+// The target and referer are recorded as the user's privacy settings allow,
+// the session token only as its fingerprint.
+func (l *Logging) Access(entry AccessEntry, privacy Privacy) {
+	target, recorded := privacy.Address(entry.Target)
+	if !recorded {
+		return
+	}
+	entry.Target = target
+	entry.Referer, _ = privacy.Address(entry.Referer)
+	entry.Session = TokenFingerprint(entry.Session)
+
+	l.output.mutex.RLock()
+	format := l.output.accessFormat
+	l.output.mutex.RUnlock()
+
+	line, err := formatAccess(entry, format)
+	if err != nil {
+		l.Error("Failed to format access log entry", "error", err)
+		return
+	}
+	l.output.visitedLogger.Println(line)
+}
+
+// ParseAccessFormat checks a configured access log format, an empty name is json
+func ParseAccessFormat(name string) (string, error) {
+	switch format := strings.ToLower(name); format {
+	case "":
+		return AccessFormatJSON, nil
+	case AccessFormatJSON, AccessFormatCommon, AccessFormatCombined:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown access log format '%s'", name)
+	}
+}
+
+// formatAccess renders an entry as a single line without the line break
+func formatAccess(entry AccessEntry, format string) (string, error) {
+	if format == AccessFormatCommon || format == AccessFormatCombined {
+		line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+			clfField(entry.ClientIP), clfField(entry.User), entry.Time.Format(clfTimeLayout),
+			strconv.Quote(entry.Method+" "+entry.Target+" "+entry.Protocol), entry.Status, clfBytes(entry.BytesOut))
+		if format == AccessFormatCombined {
+			line += fmt.Sprintf(" %s %s", strconv.Quote(clfField(entry.Referer)), strconv.Quote(clfField(entry.UserAgent)))
+		}
+		return line, nil
+	}
+
+	data, err := json.Marshal(jsonAccessEntry{
+		Time:       entry.Time.Format(time.RFC3339Nano),
+		User:       entry.User,
+		Session:    entry.Session,
+		ClientIP:   entry.ClientIP,
+		Mapping:    entry.Mapping,
+		Method:     entry.Method,
+		Target:     entry.Target,
+		Protocol:   entry.Protocol,
+		Status:     entry.Status,
+		BytesIn:    entry.BytesIn,
+		BytesOut:   entry.BytesOut,
+		DurationMS: float64(entry.Duration.Microseconds()) / 1000,
+		Referer:    entry.Referer,
+		UserAgent:  entry.UserAgent,
+	})
+	return string(data), err
+}
+
+// clfField returns "-" for empty values, as the Common Log Format expects
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// clfBytes returns the response size, "-" when nothing was sent
+func clfBytes(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
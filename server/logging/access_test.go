@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessFormats(t *testing.T) {
+	stamp := time.Date(2026, 3, 4, 5, 6, 7, 500000000, time.FixedZone("", 3600))
+	request := AccessEntry{
+		Time:      stamp,
+		User:      "alice",
+		Session:   "v1.key.payload.signature",
+		ClientIP:  "192.0.2.1",
+		Mapping:   "github",
+		Method:    "GET",
+		Target:    "https://github.com/a?q=1&token=abc",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		BytesIn:   12,
+		BytesOut:  3456,
+		Duration:  1500 * time.Microsecond,
+		Referer:   "https://example.com/?session=abc",
+		UserAgent: `curl/8.0 "quoted"`,
+	}
+	refused := AccessEntry{Time: stamp, User: "bob", ClientIP: "192.0.2.2", Method: "CONNECT", Target: "github.com:443", Protocol: "SOCKS5", Status: 403}
+	session := TokenFingerprint(request.Session)
+
+	for _, test := range []struct {
+		format string
+		want   []string
+	}{
+		{AccessFormatJSON, []string{
+			`{"time":"2026-03-04T05:06:07.5+01:00","user":"alice","session":"` + session + `","client_ip":"192.0.2.1","mapping":"github","method":"GET","target":"https://github.com/a?q=1\u0026token=REDACTED","protocol":"HTTP/1.1","status":200,"bytes_in":12,"bytes_out":3456,"duration_ms":1.5,"referer":"https://example.com/?session=REDACTED","user_agent":"curl/8.0 \"quoted\""}`,
+			`{"time":"2026-03-04T05:06:07.5+01:00","user":"bob","client_ip":"192.0.2.2","method":"CONNECT","target":"github.com:443","protocol":"SOCKS5","status":403,"bytes_in":0,"bytes_out":0,"duration_ms":0}`,
+		}},
+		{AccessFormatCommon, []string{
+			`192.0.2.1 - alice [04/Mar/2026:05:06:07 +0100] "GET https://github.com/a?q=1&token=REDACTED HTTP/1.1" 200 3456`,
+			`192.0.2.2 - bob [04/Mar/2026:05:06:07 +0100] "CONNECT github.com:443 SOCKS5" 403 -`,
+		}},
+		{AccessFormatCombined, []string{
+			`192.0.2.1 - alice [04/Mar/2026:05:06:07 +0100] "GET https://github.com/a?q=1&token=REDACTED HTTP/1.1" 200 3456 "https://example.com/?session=REDACTED" "curl/8.0 \"quoted\""`,
+			`192.0.2.2 - bob [04/Mar/2026:05:06:07 +0100] "CONNECT github.com:443 SOCKS5" 403 - "-" "-"`,
+		}},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			dir := t.TempDir()
+			logger := New(false)
+			if err := logger.InitializeLogging(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer logger.Close()
+			if err := logger.Configure(Settings{Level: "error", AccessFormat: test.format}); err != nil {
+				t.Fatal(err)
+			}
+
+			privacy := Privacy{Mode: VisitedFull, RedactParams: DefaultRedactedParams}
+			logger.Access(request, privacy)
+			logger.Access(refused, privacy)
+			// Nothing is written for users whose visits are not logged
+			logger.Access(request, Privacy{Mode: VisitedNone})
+
+			data, err := os.ReadFile(filepath.Join(dir, "visited.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(lines) != len(test.want) {
+				t.Fatalf("visited.log has %d lines, want %d:\n%s", len(lines), len(test.want), data)
+			}
+			for i, want := range test.want {
+				if lines[i] != want {
+					t.Errorf("line %d:\n got %s\nwant %s", i+1, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAccessFormat(t *testing.T) {
+	for name, want := range map[string]string{"": AccessFormatJSON, "JSON": AccessFormatJSON, "common": AccessFormatCommon, "Combined": AccessFormatCombined} {
+		if got, err := ParseAccessFormat(name); got != want || err != nil {
+			t.Errorf("ParseAccessFormat(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseAccessFormat("apache"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
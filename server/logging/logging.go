@@ -1,55 +1,229 @@
 package logging
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 )
 
-type Logging struct {
-    fileLogger *log.Logger
-	consoleLogger *log.Logger
-    logFile *os.File
+// Output formats of the server log
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Settings selects the level and format of the server log, the format of
+// the access log and how server.log and visited.log are rotated
+type Settings struct {
+	Level        string // debug, info, warn or error
+	Format       string // text or json
+	AccessFormat string // json, common or combined
+	Rotation     Rotation
+}
+
+// output is shared by a Logging and all loggers derived from it, so that a
+// new level or format also applies to component loggers created earlier
+type output struct {
+	mutex         sync.RWMutex
+	handler       slog.Handler
+	level         slog.LevelVar
+	format        string
+	accessFormat  string
+	forceDebug    bool
+	logFile       *RotatingFile
+	visitedFile   *RotatingFile
 	visitedLogger *log.Logger
-    visitedFile *os.File
-    isVerbose bool
 }
 
-// Initialize
+// Logging writes leveled, structured log records to the console and server.log.
+// Loggers for a component or with request fields are derived with Component and With.
+type Logging struct {
+	logger *slog.Logger
+	output *output
+}
+
+// Initialize, output only goes to the console until InitializeLogging is called.
+// Verbose logging forces the debug level regardless of the configured one.
 func New(isVerbose bool) *Logging {
-	l := &Logging{}
-	l.consoleLogger = log.New(os.Stdout, "", log.LstdFlags)
-	l.isVerbose = isVerbose
-	return l
+	o := &output{
+		format:        FormatText,
+		accessFormat:  AccessFormatJSON,
+		forceDebug:    isVerbose,
+		visitedLogger: log.New(io.Discard, "", 0),
+	}
+	if isVerbose {
+		o.level.Set(slog.LevelDebug)
+	}
+	o.rebuild()
+	return &Logging{logger: slog.New(&handler{output: o}), output: o}
+}
+
+// InitializeLogging opens server.log and visited.log in the given directory
+func (l *Logging) InitializeLogging(path string) error {
+	if err := l.openLog(path); err != nil {
+		return err
+	}
+	return l.openVisited(path)
 }
 
-// SetPath sets the path for the log file
-func (l *Logging) InitializeLogging(path string) {
-	l.openLog(path)
-	l.openVisited(path)
+// Configure changes the level and format, it can be called again on every config reload
+func (l *Logging) Configure(settings Settings) error {
+	level, err := ParseLevel(settings.Level)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(settings.Format)
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format '%s'", settings.Format)
+	}
+	accessFormat, err := ParseAccessFormat(settings.AccessFormat)
+	if err != nil {
+		return err
+	}
+
+	o := l.output
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.logFile != nil {
+		o.logFile.SetRotation(settings.Rotation)
+	}
+	if o.visitedFile != nil {
+		o.visitedFile.SetRotation(settings.Rotation)
+	}
+	o.accessFormat = accessFormat
+	if !o.forceDebug {
+		o.level.Set(level)
+	}
+	if format != o.format {
+		o.format = format
+		o.rebuildLocked()
+	}
+	return nil
+}
+
+// ParseLevel converts a configured level name, an empty name is info
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level '%s'", name)
+	}
+}
+
+// Component returns a logger whose records carry the component name
+func (l *Logging) Component(name string) *Logging {
+	return l.With("component", name)
+}
+
+// With returns a logger that adds the given key/value pairs to every record
+func (l *Logging) With(args ...any) *Logging {
+	return &Logging{logger: l.logger.With(args...), output: l.output}
+}
+
+// StdLogger returns a standard library logger writing records of the given
+// level, for third party packages that log through *log.Logger
+func (l *Logging) StdLogger(level slog.Level) *log.Logger {
+	return slog.NewLogLogger(l.logger.Handler(), level)
+}
+
+// FilteredStdLogger is like StdLogger, but passes every message through filter
+// first. Messages for which filter returns false are dropped.
+func (l *Logging) FilteredStdLogger(level slog.Level, filter func(message string) (string, bool)) *log.Logger {
+	return log.New(&filterWriter{logger: l.logger, level: level, filter: filter}, "", 0)
+}
+
+// filterWriter writes the messages of a *log.Logger to a slog logger
+type filterWriter struct {
+	logger *slog.Logger
+	level  slog.Level
+	filter func(message string) (string, bool)
+}
+
+func (w *filterWriter) Write(p []byte) (int, error) {
+	if message, keep := w.filter(strings.TrimSuffix(string(p), "\n")); keep {
+		w.logger.Log(context.Background(), w.level, message)
+	}
+	return len(p), nil
 }
 
 // openLog opens a log file for writing
-func (l *Logging) openLog(path string) {
+func (l *Logging) openLog(path string) error {
 	var err error
-	l.logFile, err = os.OpenFile(path + "/server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	l.output.logFile, err = OpenRotatingFile(path + "/server.log", Rotation{})
 	if err != nil {
-		l.consoleLogger.Fatalf("Failed to open log file: %s", err)
+		return fmt.Errorf("failed to open log file: %w", err)
 	}
-	l.fileLogger = log.New(l.logFile, "", 0)
+	l.output.rebuild()
+	return nil
 }
 
-// openVisited opens a file for visited addresses
-func (l *Logging) openVisited(path string) {
+// openVisited opens the access log of proxied requests and connections
+func (l *Logging) openVisited(path string) error {
 	var err error
-	l.visitedFile, err = os.OpenFile(path + "/visited.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	l.output.visitedFile, err = OpenRotatingFile(path + "/visited.log", Rotation{})
 	if err != nil {
-		l.Fatalf("Failed to open visited file: %s", err)
+		return fmt.Errorf("failed to open visited file: %w", err)
+	}
+	l.output.visitedLogger = log.New(l.output.visitedFile, "", 0)
+	return nil
+}
+
+// Reopen opens server.log and visited.log again, for use after an external
+// tool like logrotate moved them away. Records go to the console meanwhile.
+func (l *Logging) Reopen() {
+	for _, file := range []*RotatingFile{l.output.logFile, l.output.visitedFile} {
+		if file == nil {
+			continue
+		}
+		if err := file.Reopen(); err != nil {
+			l.Error("Failed to reopen log file", "error", err)
+		}
 	}
-	l.visitedLogger = log.New(l.visitedFile, "", 0)
 }
 
 // Close closes the log and visited files
 func (l *Logging) Close() {
-	l.logFile.Close()
-	l.visitedFile.Close()
-}
\ No newline at end of file
+	for _, file := range []*RotatingFile{l.output.logFile, l.output.visitedFile} {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// rebuild replaces the handler after the log file or format changed
+func (o *output) rebuild() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.rebuildLocked()
+}
+
+// rebuildLocked is rebuild for callers holding the lock
+func (o *output) rebuildLocked() {
+	var writer io.Writer = os.Stdout
+	if o.logFile != nil {
+		writer = io.MultiWriter(os.Stdout, o.logFile)
+	}
+
+	options := &slog.HandlerOptions{Level: &o.level, ReplaceAttr: redactAttr}
+	if o.format == FormatJSON {
+		o.handler = slog.NewJSONHandler(writer, options)
+	} else {
+		o.handler = slog.NewTextHandler(writer, options)
+	}
+}
@@ -1,63 +1,73 @@
 package logging
 
-// Logln writes a message to the log file as a single line
-func (l *Logging) Logln(message string) {
-	l.fileLogger.Println(message)
-	l.consoleLogger.Println(message)
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// Debug writes a record for troubleshooting, hidden unless the level is debug
+func (l *Logging) Debug(message string, args ...any) {
+	l.logger.Debug(message, args...)
 }
 
-// Logf writes a message to the log file and with formatting
-func (l *Logging) Logf(format string, v ...interface{}) {
-	l.fileLogger.Printf(format, v...)
-	l.consoleLogger.Printf(format, v...)
+// Info writes a record about normal operation
+func (l *Logging) Info(message string, args ...any) {
+	l.logger.Info(message, args...)
 }
 
-// Visitedln writes a visited address to the visited file as a single line
-func (l *Logging) Visitedln(address string) {
-	l.visitedFile.WriteString(address + "\n")
+// Warn writes a record about a refused request or a recoverable problem
+func (l *Logging) Warn(message string, args ...any) {
+	l.logger.Warn(message, args...)
 }
 
-// Visitedf writes a visited address to the visited file with formatting
-func (l *Logging) Visitedf(format string, v ...interface{}) {
-	l.visitedLogger.Printf(format, v...)
+// Error writes a record about a failure that needs attention
+func (l *Logging) Error(message string, args ...any) {
+	l.logger.Error(message, args...)
 }
 
-// Verboseln writes a verbose message to the log file as a single line
-func (l *Logging) Verboseln(message string) {
-	if l.isVerbose {
-		l.fileLogger.Println(message)
-		l.consoleLogger.Println(message)
-	}
+// Fatal writes an error record and exits the process
+func (l *Logging) Fatal(message string, args ...any) {
+	l.logger.Error(message, args...)
+	os.Exit(1)
 }
 
-// Verbosef writes a verbose message to the log file with formatting
-func (l *Logging) Verbosef(format string, v ...interface{}) {
-	if l.isVerbose {
-		l.fileLogger.Printf(format, v...)
-		l.consoleLogger.Printf(format, v...)
-	}
+// handler forwards records to the current handler of the shared output.
+// The attributes and groups of derived loggers are replayed on top of it.
+type handler struct {
+	output *output
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.output.level.Level()
 }
 
-// Fatalln writes a fatal message to the log file as a single line
-func (l *Logging) Fatalln(message string) {
-	l.fileLogger.Fatalln(message)
-	l.consoleLogger.Fatalln(message)
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	h.output.mutex.RLock()
+	target := h.output.handler
+	h.output.mutex.RUnlock()
+
+	for _, derive := range h.derive {
+		target = derive(target)
+	}
+	return target.Handle(ctx, record)
 }
 
-// Fatalf writes a fatal message to the log file with formatting
-func (l *Logging) Fatalf(format string, v ...interface{}) {
-	l.fileLogger.Fatalf(format, v...)
-	l.consoleLogger.Fatalf(format, v...)
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(target slog.Handler) slog.Handler {
+		return target.WithAttrs(attrs)
+	})
 }
 
-// Panic writes a panic message to the log file
-func (l *Logging) Panicln(message string) {
-	l.fileLogger.Panicln(message)
-	l.consoleLogger.Panicln(message)
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(target slog.Handler) slog.Handler {
+		return target.WithGroup(name)
+	})
 }
 
-// Panicf writes a panic message to the log file with formatting
-func (l *Logging) Panicf(format string, v ...interface{}) {
-	l.fileLogger.Panicf(format, v...)
-	l.consoleLogger.Panicf(format, v...)
-}
\ No newline at end of file
+func (h *handler) with(derive func(slog.Handler) slog.Handler) *handler {
+	chain := make([]func(slog.Handler) slog.Handler, len(h.derive), len(h.derive)+1)
+	copy(chain, h.derive)
+	return &handler{output: h.output, derive: append(chain, derive)}
+}
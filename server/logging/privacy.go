@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Ways of recording visited addresses
+const (
+	VisitedFull   = "full"   // The full URL, with sensitive query parameters redacted
+	VisitedHost   = "host"   // Only the scheme and host, or host:port
+	VisitedHashed = "hashed" // A keyed hash of the address, equal addresses give equal hashes
+	VisitedNone   = "none"   // Nothing, the request is left out of visited.log
+)
+
+// Redacted replaces sensitive values in log output
+const Redacted = "REDACTED"
+
+// DefaultRedactedParams are the query parameters redacted when none are configured
+var DefaultRedactedParams = []string{"*token*", "*key*", "*secret*", "*password*", "*auth*", "*signature*", "*session*"}
+
+// Privacy decides how the visited addresses of a user are recorded
+type Privacy struct {
+	Mode         string   // full, host, hashed or none
+	RedactParams []string // Glob patterns of query parameter names, matched case-insensitively
+	HashKey      []byte   // Key of the hashed mode
+}
+
+// Address returns how a URL, path or host:port is recorded. It returns
+// false if the mode records nothing.
+func (p Privacy) Address(address string) (string, bool) {
+	if address == "" {
+		return "", p.Mode != VisitedNone
+	}
+
+	switch p.Mode {
+	case VisitedNone:
+		return "", false
+	case VisitedHost:
+		return hostOf(address), true
+	case VisitedHashed:
+		mac := hmac.New(sha256.New, p.HashKey)
+		mac.Write([]byte(p.redactQuery(address)))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)), true
+	default:
+		return p.redactQuery(address), true
+	}
+}
+
+// redactQuery replaces the values of matching query parameters, keeping their order
+func (p Privacy) redactQuery(address string) string {
+	base, query, found := strings.Cut(address, "?")
+	if !found || len(p.RedactParams) == 0 {
+		return address
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if p.redacts(strings.ToLower(name)) {
+			params[i] = url.QueryEscape(name) + "=" + Redacted
+		}
+	}
+	return base + "?" + strings.Join(params, "&")
+}
+
+// redacts reports whether a lower case parameter name matches a redaction pattern
+func (p Privacy) redacts(name string) bool {
+	for _, pattern := range p.RedactParams {
+		if ok, err := path.Match(strings.ToLower(pattern), name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOf strips the path and query of a URL. Bare paths have no host and
+// give an empty string, host:port addresses are returned unchanged.
+func hostOf(address string) string {
+	if strings.HasPrefix(address, "/") {
+		return ""
+	}
+	if parsed, err := url.Parse(address); err == nil && parsed.Host != "" {
+		return parsed.Scheme + "://" + parsed.Host
+	}
+	return address
+}
+
+// TokenFingerprint identifies a session token in log output without revealing
+// it. The same token always gives the same fingerprint.
+func TokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// redactAttr keeps credentials out of the server log, passwords are never
+// written and session tokens only as their fingerprint
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	switch strings.ToLower(attr.Key) {
+	case "password":
+		return slog.String(attr.Key, Redacted)
+	case "session", "session_token":
+		return slog.String(attr.Key, TokenFingerprint(attr.Value.String()))
+	}
+	return attr
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPrivacyAddress(t *testing.T) {
+	redact := DefaultRedactedParams
+	for _, test := range []struct {
+		name     string
+		privacy  Privacy
+		address  string
+		want     string
+		recorded bool
+	}{
+		{"full", Privacy{Mode: VisitedFull}, "https://github.com/a?q=1", "https://github.com/a?q=1", true},
+		{"full redacts", Privacy{Mode: VisitedFull, RedactParams: redact}, "https://github.com/a?q=1&Access_Token=abc&x", "https://github.com/a?q=1&Access_Token=REDACTED&x", true},
+		{"full escaped name", Privacy{Mode: VisitedFull, RedactParams: redact}, "/a?api%5Fkey=abc", "/a?api_key=REDACTED", true},
+		{"empty mode is full", Privacy{RedactParams: []string{"sid"}}, "/a?sid=1&SID=2&sidx=3", "/a?sid=REDACTED&SID=REDACTED&sidx=3", true},
+		{"host", Privacy{Mode: VisitedHost}, "https://github.com:8443/a?token=abc", "https://github.com:8443", true},
+		{"host of a path", Privacy{Mode: VisitedHost}, "/a/b", "", true},
+		{"host of host:port", Privacy{Mode: VisitedHost}, "github.com:22", "github.com:22", true},
+		{"none", Privacy{Mode: VisitedNone}, "https://github.com/a", "", false},
+		{"none of empty", Privacy{Mode: VisitedNone}, "", "", false},
+		{"empty address", Privacy{Mode: VisitedHashed}, "", "", true},
+	} {
+		got, recorded := test.privacy.Address(test.address)
+		if got != test.want || recorded != test.recorded {
+			t.Errorf("%s: Address(%q) = %q, %v, want %q, %v", test.name, test.address, got, recorded, test.want, test.recorded)
+		}
+	}
+}
+
+func TestPrivacyHashed(t *testing.T) {
+	privacy := Privacy{Mode: VisitedHashed, RedactParams: DefaultRedactedParams, HashKey: []byte("key")}
+	first, _ := privacy.Address("https://github.com/a?token=one")
+	second, _ := privacy.Address("https://github.com/a?token=two")
+	other, _ := privacy.Address("https://github.com/b")
+
+	if !strings.HasPrefix(first, "hmac-sha256:") || strings.Contains(first, "github") {
+		t.Errorf("hashed address %q reveals the address", first)
+	}
+	// Redaction happens before hashing, so secrets do not change the hash
+	if first != second {
+		t.Error("addresses differing only in a redacted parameter hash differently")
+	}
+	if first == other {
+		t.Error("different addresses hash equally")
+	}
+
+	rekeyed := privacy
+	rekeyed.HashKey = []byte("other key")
+	if hash, _ := rekeyed.Address("https://github.com/a"); hash == first {
+		t.Error("the hash does not depend on the key")
+	}
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	token := "d2290398-e4fa-45ae-848c-e0a45e0afe65"
+	fingerprint := TokenFingerprint(token)
+	if len(fingerprint) != 16 || strings.Contains(token, fingerprint) {
+		t.Errorf("fingerprint = %q", fingerprint)
+	}
+	if TokenFingerprint(token) != fingerprint {
+		t.Error("the fingerprint of a token changed")
+	}
+	if TokenFingerprint("other") == fingerprint {
+		t.Error("different tokens have the same fingerprint")
+	}
+	if TokenFingerprint("") != "" {
+		t.Error("an empty token has a fingerprint")
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	for _, test := range []struct {
+		attr slog.Attr
+		want string
+	}{
+		{slog.String("password", "secret"), Redacted},
+		{slog.String("Password", "secret"), Redacted},
+		{slog.String("session", "token"), TokenFingerprint("token")},
+		{slog.String("session_token", "token"), TokenFingerprint("token")},
+		{slog.String("user", "alice"), "alice"},
+	} {
+		if got := redactAttr(nil, test.attr).Value.String(); got != test.want {
+			t.Errorf("redactAttr(%s) = %q, want %q", test.attr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efebaykaraa/domain-dedicated-isp-bypass/server/atomicfile"
+)
+
+// backupTimeLayout is appended to the name of rotated files, it sorts by time
+const backupTimeLayout = "2006-01-02T15-04-05.000"
+
+// startedSuffix names the file next to the log that records when the log was
+// started. The log's own modification time changes with every write, so it
+// cannot tell the age of a file that outlived a restart.
+const startedSuffix = ".started"
+
+// Rotation limits the size and age of a log file and how many rotated files are kept
+type Rotation struct {
+	MaxSize    int64         // Bytes, 0 disables size based rotation
+	MaxAge     time.Duration // Age of the current file, 0 disables age based rotation
+	MaxBackups int           // Rotated files to keep, 0 keeps all of them
+	Compress   bool          // Gzip rotated files
+}
+
+// RotatingFile is an append-only log file that is rotated once it grows too
+// large or too old. Rotated files get a timestamp suffix, are optionally
+// compressed, and the oldest are removed beyond the retention count.
+type RotatingFile struct {
+	path     string
+	file     *os.File
+	size     int64
+	opened   time.Time // When the current file was started, kept in the .started file across restarts
+	rotation Rotation
+	mutex    sync.Mutex
+	cleanup  sync.Mutex     // Serializes compressing and removing backups
+	pending  sync.WaitGroup // Cleanups still running
+}
+
+// OpenRotatingFile opens or creates the log file at path
+func OpenRotatingFile(path string, rotation Rotation) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends to the file, rotating it first if p would exceed the limits
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.shouldRotate(int64(len(p))) {
+		// A failed rotation keeps writing to the current path if it could be reopened
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// SetRotation changes the limits, they apply from the next write
+func (f *RotatingFile) SetRotation(rotation Rotation) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rotation = rotation
+}
+
+// Reopen closes the file and opens the path again. After an external tool
+// like logrotate moved the file away, this starts writing to a new one.
+func (f *RotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close closes the file and waits for running compressions
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mutex.Unlock()
+
+	f.pending.Wait()
+	return err
+}
+
+// open opens the path for appending. The caller must hold the lock.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.started(info)
+	return nil
+}
+
+// started returns when the file was started. A file continued from an earlier
+// run keeps the start recorded back then, a new or empty file starts now.
+// The caller must hold the lock.
+func (f *RotatingFile) started(info os.FileInfo) time.Time {
+	now := time.Now()
+	if f.size > 0 {
+		if data, err := os.ReadFile(f.path + startedSuffix); err == nil {
+			if started, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data))); err == nil && !started.After(now) {
+				return started
+			}
+		}
+		// Files written before the start was recorded are at least as old as their last write
+		if info.ModTime().Before(now) {
+			now = info.ModTime()
+		}
+	}
+	// Without the record the age restarts at the next open, rotation still works by size
+	atomicfile.Write(f.path+startedSuffix, []byte(now.Format(time.RFC3339Nano)+"\n"))
+	return now
+}
+
+// shouldRotate reports whether the current file is full or too old. The caller must hold the lock.
+func (f *RotatingFile) shouldRotate(incoming int64) bool {
+	if f.rotation.MaxSize > 0 && f.size+incoming > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.MaxAge > 0 && time.Since(f.opened) >= f.rotation.MaxAge
+}
+
+// rotate moves the current file aside, starts a new one and cleans up
+// the backups in the background. The caller must hold the lock.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup := f.path + "." + time.Now().Format(backupTimeLayout)
+	renameErr := os.Rename(f.path, backup)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	rotation := f.rotation
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+
+		if rotation.Compress {
+			compress(backup)
+		}
+		f.removeOldBackups(rotation.MaxBackups)
+	}()
+	return nil
+}
+
+// removeOldBackups deletes the oldest rotated files beyond the retention count
+func (f *RotatingFile) removeOldBackups(keep int) {
+	if keep <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+
+	// Only count files this writer created, the suffix is a timestamp with an optional .gz
+	var rotated []string
+	prefix := filepath.Base(f.path) + "."
+	for _, backup := range backups {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(backup), prefix), ".gz")
+		if _, err := time.Parse(backupTimeLayout, suffix); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	if len(rotated) <= keep {
+		return
+	}
+
+	sort.Strings(rotated)
+	for _, backup := range rotated[:len(rotated)-keep] {
+		os.Remove(backup)
+	}
+}
+
+// compress gzips a rotated file and removes the original. Failures keep the
+// uncompressed file, so nothing is lost.
+func compress(path string) {
+	source, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	writer := gzip.NewWriter(target)
+	_, copyErr := io.Copy(writer, source)
+	closeErr := writer.Close()
+	if err := target.Close(); err != nil || copyErr != nil || closeErr != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	os.Remove(path)
+}
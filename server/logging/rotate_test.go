@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backups returns the rotated files next to path
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotated []string
+	for _, match := range matches {
+		if match != path+startedSuffix {
+			rotated = append(rotated, match)
+		}
+	}
+	return rotated
+}
+
+// writeLines writes count lines, pausing so every rotation gets its own backup name
+func writeLines(t *testing.T, f *RotatingFile, line string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenRotatingFile(path, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "12345678\n", 3)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated := backups(t, path); len(rotated) != 2 {
+		t.Errorf("%d backups, want 2", len(rotated))
+	}
+	if data, _ := os.ReadFile(path); string(data) != "12345678\n" {
+		t.Errorf("current file contains %q", data)
+	}
+}
+
+func TestRotateKeepsMaxBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	// Files that only share the prefix are not backups and must survive
+	if err := os.WriteFile(path+".keep", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, Rotation{MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "line\n", 6)
+	f.Close()
+
+	rotated := backups(t, path)
+	if len(rotated) != 3 {
+		t.Errorf("files next to the log = %v, want 2 backups and the unrelated file", rotated)
+	}
+	if _, err := os.Stat(path + ".keep"); err != nil {
+		t.Error("an unrelated file was removed")
+	}
+}
+
+func TestRotateCompresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenRotatingFile(path, Rotation{MaxSize: 1, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "first\n", 1)
+	writeLines(t, f, "second\n", 1)
+	f.Close()
+
+	rotated := backups(t, path)
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".gz") {
+		t.Fatalf("backups = %v, want one gzipped file", rotated)
+	}
+	file, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(reader); string(data) != "first\n" {
+		t.Errorf("backup contains %q, want %q", data, "first\n")
+	}
+}
+
+func TestRotateByAgeAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	rotation := Rotation{MaxAge: 300 * time.Millisecond}
+
+	// Every run writes on startup and shutdown, so the file looks fresh when
+	// the next run opens it
+	for run := 0; run < 3; run++ {
+		f, err := OpenRotatingFile(path, rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLines(t, f, "Server started\n", 1)
+		time.Sleep(120 * time.Millisecond)
+		writeLines(t, f, "Server stopped\n", 1)
+		f.Close()
+	}
+
+	if rotated := backups(t, path); len(rotated) != 1 {
+		t.Errorf("%d backups after restarts past max_age, want 1", len(rotated))
+	}
+}
+
+func TestRotatedFileStartsNow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenRotatingFile(path, Rotation{MaxAge: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "first\n", 1)
+	time.Sleep(250 * time.Millisecond)
+	writeLines(t, f, "second\n", 1)
+	f.Close()
+
+	// The new file records its own start, reopening it must not rotate again
+	f, err = OpenRotatingFile(path, Rotation{MaxAge: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "third\n", 1)
+	f.Close()
+
+	if rotated := backups(t, path); len(rotated) != 1 {
+		t.Errorf("%d backups, want 1", len(rotated))
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second\nthird\n" {
+		t.Errorf("current file contains %q", data)
+	}
+}
+
+func TestRotateFileWithoutStartRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	if err := os.WriteFile(path, []byte("from an older version\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a record the last write is the best known start
+	f, err := OpenRotatingFile(path, Rotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "new\n", 1)
+	f.Close()
+
+	if rotated := backups(t, path); len(rotated) != 1 {
+		t.Errorf("%d backups, want 1", len(rotated))
+	}
+}
+
+func TestReopenAfterExternalRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenRotatingFile(path, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeLines(t, f, "before\n", 1)
+
+	// logrotate moves the file away and signals the server
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "after\n", 1)
+
+	if data, _ := os.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("new file contains %q", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "before\n" {
+		t.Errorf("moved file contains %q", data)
+	}
+}
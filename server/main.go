@@ -1,53 +1,156 @@
 package main
 
 import (
+    "context"
+    "flag"
+    "fmt"
     "os"
+    "os/signal"
+    "syscall"
 
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/app"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
-    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
-    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/proxy"
-    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
 )
 
-var (
-    cfg          *config.Config
-    logg         *logging.Logging
-    sessionStore *session.SessionStore
-)
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
-func init() {
-    configPath := "config.json"
+const usage = `Usage: server [command] [flags]
 
-    // Check if a config file path is provided as an argument
-    if len(os.Args) > 1 {
-        configPath = os.Args[1]
-    }
+Commands:
+  serve          Run the HTTP and SOCKS5 proxies (default)
+  check-config   Load the config file and report problems
+  hash-password  Hash a password read from stdin for user_credentials
+  version        Print the version
 
-    // Initialize logging
-    logg = logging.New(true)
+Run 'server <command> -h' for the flags of a command.
+`
 
-    if len(os.Args) > 2 {
-        logg.InitializeLogging(os.Args[2])
-    } else {
-        logg.InitializeLogging(".")
+func main() {
+    os.Exit(run(os.Args[1:]))
+}
+
+// run dispatches to a subcommand and returns the process exit code
+func run(args []string) int {
+    command := "serve"
+    if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+        switch args[0] {
+        case "serve", "check-config", "hash-password", "version":
+            command, args = args[0], args[1:]
+        case "help":
+            fmt.Print(usage)
+            return 0
+        }
     }
 
-    cfg = config.LoadConfig(configPath, logg)
+    switch command {
+    case "check-config":
+        return runCheckConfig(args)
+    case "hash-password":
+        return runHashPassword(args)
+    case "version":
+        fmt.Println(version)
+        return 0
+    default:
+        return runServe(args)
+    }
+}
 
-    // Initialize session store
-    sessionStore = session.NewSessionStore()
+// addConfigFlag registers the config path flag shared by serve and check-config
+func addConfigFlag(flags *flag.FlagSet, options *app.Options) {
+    flags.StringVar(&options.ConfigPath, "config", "config.json", "path of the config file")
+}
+
+// runServe implements the serve subcommand. For compatibility the config path
+// and log directory may still be given as positional arguments.
+func runServe(args []string) int {
+    var options app.Options
+    flags := flag.NewFlagSet("serve", flag.ExitOnError)
+    addConfigFlag(flags, &options)
+    flags.StringVar(&options.LogDir, "log-dir", ".", "directory for server.log and visited.log")
+    flags.BoolVar(&options.Verbose, "verbose", false, "log at debug level, overriding the configured level")
+    flags.StringVar(&options.HTTPListen, "http-listen", "", "override the HTTP proxy listen address")
+    flags.StringVar(&options.SOCKSListen, "socks-listen", "", "override the SOCKS5 proxy listen address")
+    flags.StringVar(&options.AdminListen, "admin-listen", "", "override the admin listen address serving /metrics")
+    flags.DurationVar(&options.ShutdownTimeout, "shutdown-timeout", app.DefaultShutdownTimeout, "how long to drain connections on SIGINT/SIGTERM")
+
+    positional, err := parseFlags(flags, args, 2)
+    if err != nil {
+        return 2
+    }
+    if len(positional) > 0 {
+        options.ConfigPath = positional[0]
+    }
+    if len(positional) > 1 {
+        options.LogDir = positional[1]
+    }
 
-    // Watch configuration changes
-    go cfg.WatchConfig()
+    // Stop gracefully on SIGINT/SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    server, err := app.New(options)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to start: %s\n", err)
+        return 1
+    }
+    if err := server.Run(ctx); err != nil {
+        fmt.Fprintf(os.Stderr, "Server stopped: %s\n", err)
+        return 1
+    }
+    return 0
 }
 
-func main() {
-    // Start HTTP proxy (for HTTP/HTTPS traffic)
-    go proxy.StartHTTPProxy(cfg, logg, sessionStore)
+// runCheckConfig implements the check-config subcommand. Like serve it
+// accepts the config path as a positional argument.
+func runCheckConfig(args []string) int {
+    var options app.Options
+    flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+    addConfigFlag(flags, &options)
+
+    positional, err := parseFlags(flags, args, 1)
+    if err != nil {
+        return 2
+    }
+    if len(positional) > 0 {
+        options.ConfigPath = positional[0]
+    }
+
+    if err := config.CheckConfig(options.ConfigPath); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %s\n", options.ConfigPath, err)
+        return 1
+    }
+    fmt.Printf("%s: OK\n", options.ConfigPath)
+    return 0
+}
 
-    // Start SOCKS5 proxy (for TCP and UDP traffic)
-    go proxy.StartSOCKS5Proxy(cfg, logg, sessionStore)
+// parseFlags parses flags before, between and after the positional arguments,
+// which the flag package alone stops parsing at the first positional one.
+// Everything after "--" is positional. More than max positional arguments
+// are reported as an error after printing the usage.
+func parseFlags(flags *flag.FlagSet, args []string, max int) ([]string, error) {
+    var positional []string
+    for {
+        if err := flags.Parse(args); err != nil {
+            return nil, err
+        }
+        rest := flags.Args()
+        if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+            positional = append(positional, rest...)
+            break
+        }
+        if len(rest) == 0 {
+            break
+        }
+        positional = append(positional, rest[0])
+        args = rest[1:]
+    }
 
-    // Block main goroutine
-    select {}
+    if len(positional) > max {
+        err := fmt.Errorf("unexpected argument %q", positional[max])
+        fmt.Fprintf(flags.Output(), "%s\n", err)
+        flags.Usage()
+        return nil, err
+    }
+    return positional, nil
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "flag"
+    "io"
+    "reflect"
+    "testing"
+)
+
+func TestParseFlagsAfterPositionalArguments(t *testing.T) {
+    for _, test := range []struct {
+        args       []string
+        listen     string
+        positional []string
+        fails      bool
+    }{
+        {args: []string{"config.json", "--http-listen", ":9000"}, listen: ":9000", positional: []string{"config.json"}},
+        {args: []string{"--http-listen", ":9000", "config.json", "logs"}, listen: ":9000", positional: []string{"config.json", "logs"}},
+        {args: []string{"config.json", "-http-listen=:9000", "logs"}, listen: ":9000", positional: []string{"config.json", "logs"}},
+        {args: []string{"--", "-config.json"}, positional: []string{"-config.json"}},
+        {args: []string{"config.json", "logs", "extra"}, fails: true},
+        {args: []string{"config.json", "--unknown"}, fails: true},
+    } {
+        flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+        flags.SetOutput(io.Discard)
+        listen := flags.String("http-listen", "", "")
+
+        positional, err := parseFlags(flags, test.args, 2)
+        if test.fails {
+            if err == nil {
+                t.Errorf("%q: parsed without error", test.args)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%q: %s", test.args, err)
+            continue
+        }
+        if *listen != test.listen || !reflect.DeepEqual(positional, test.positional) {
+            t.Errorf("%q: listen %q, positional %q, want %q, %q", test.args, *listen, positional, test.listen, test.positional)
+        }
+    }
+}
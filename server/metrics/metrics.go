@@ -0,0 +1,109 @@
+package metrics
+
+import (
+    "net/http"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes the name of every metric
+const namespace = "isp_bypass"
+
+// Metrics holds the Prometheus collectors of the server. The proxies record
+// into it whether or not the admin listener serves it.
+type Metrics struct {
+    registry *prometheus.Registry
+
+    Handshakes       *prometheus.CounterVec   // result
+    ProxiedRequests  *prometheus.CounterVec   // mapping, status
+    UpstreamLatency  *prometheus.HistogramVec // mapping
+    BytesTransferred *prometheus.CounterVec   // protocol, direction
+    SOCKSConnections *prometheus.CounterVec   // result
+    OpenSOCKSConns   prometheus.Gauge
+    AuthFailures     *prometheus.CounterVec // protocol, reason
+    ConfigReloads    *prometheus.CounterVec // result
+}
+
+// New creates the collectors and registers them with the Go runtime and process metrics.
+func New() *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        Handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "handshakes_total",
+            Help:      "Handshakes by result.",
+        }, []string{"result"}),
+        ProxiedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "http_requests_total",
+            Help:      "Proxied HTTP requests by domain mapping and response status.",
+        }, []string{"mapping", "status"}),
+        UpstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: namespace,
+            Name:      "upstream_duration_seconds",
+            Help:      "Time until the upstream server returned the response headers, by domain mapping.",
+            Buckets:   prometheus.DefBuckets,
+        }, []string{"mapping"}),
+        BytesTransferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "bytes_total",
+            Help:      "Bytes received from (in) and sent to (out) clients, by protocol.",
+        }, []string{"protocol", "direction"}),
+        SOCKSConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "socks_connections_total",
+            Help:      "SOCKS5 CONNECT requests by result.",
+        }, []string{"result"}),
+        OpenSOCKSConns: prometheus.NewGauge(prometheus.GaugeOpts{
+            Namespace: namespace,
+            Name:      "socks_open_connections",
+            Help:      "SOCKS5 connections currently proxied.",
+        }),
+        AuthFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "auth_failures_total",
+            Help:      "Refused authentications by protocol and reason.",
+        }, []string{"protocol", "reason"}),
+        ConfigReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name:      "config_reloads_total",
+            Help:      "Config reloads by result.",
+        }, []string{"result"}),
+    }
+
+    m.registry.MustRegister(
+        m.Handshakes, m.ProxiedRequests, m.UpstreamLatency, m.BytesTransferred,
+        m.SOCKSConnections, m.OpenSOCKSConns, m.AuthFailures, m.ConfigReloads,
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+    return m
+}
+
+// WatchSessions exports the number of live sessions. Stateless session
+// stores cannot count their sessions, the metric is left out for them.
+func (m *Metrics) WatchSessions(count func() int) {
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Name:      "active_sessions",
+        Help:      "Live sessions in the session store.",
+    }, func() float64 {
+        return float64(count())
+    }))
+}
+
+// ConfigReloaded counts the outcome of a config reload
+func (m *Metrics) ConfigReloaded(err error) {
+    if err != nil {
+        m.ConfigReloads.WithLabelValues("failure").Inc()
+        return
+    }
+    m.ConfigReloads.WithLabelValues("success").Inc()
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+// AdminServer serves /metrics on the admin listener, apart from the proxies
+// so that it can be kept off the public network.
+type AdminServer struct {
+    server  *http.Server
+    address string
+    Logging *logging.Logging
+}
+
+// NewAdminServer creates the admin server, it starts serving with ListenAndServe.
+func NewAdminServer(address string, metrics *Metrics, logging *logging.Logging) *AdminServer {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", metrics.Handler())
+
+    logging = logging.Component("admin")
+    return &AdminServer{
+        server: &http.Server{
+            Handler:           mux,
+            ReadHeaderTimeout: 10 * time.Second,
+            ErrorLog:          logging.StdLogger(slog.LevelWarn),
+        },
+        address: address,
+        Logging: logging,
+    }
+}
+
+// ListenAndServe listens on the admin address and blocks until Shutdown is called.
+func (s *AdminServer) ListenAndServe() error {
+    listener, err := net.Listen("tcp", s.address)
+    if err != nil {
+        return fmt.Errorf("failed to listen on %s: %w", s.address, err)
+    }
+    s.Logging.Info("Starting admin listener", "address", s.address)
+
+    if err := s.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+// Shutdown stops the admin listener and waits for running scrapes until ctx expires.
+func (s *AdminServer) Shutdown(ctx context.Context) error {
+    return s.server.Shutdown(ctx)
+}
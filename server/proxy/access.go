@@ -0,0 +1,199 @@
+package proxy
+
+import (
+    "context"
+    "io"
+    "net"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/armon/go-socks5"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+    "github.com/valyala/fasthttp"
+)
+
+// httpAccess collects the access log entry of a proxied HTTP request while it is handled
+type httpAccess struct {
+    entry    logging.AccessEntry
+    bytesIn  atomic.Int64 // Received from the client
+    bytesOut atomic.Int64 // Sent to the client
+    streamed bool // The response body is streamed, the stream writes the entry when closed
+    privacy  logging.Privacy // Global settings until the user is known
+    logging  *logging.Logging
+    metrics  *metrics.Metrics
+}
+
+func newHTTPAccess(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, m *metrics.Metrics) *httpAccess {
+    return &httpAccess{
+        entry: logging.AccessEntry{
+            Time:      time.Now(),
+            ClientIP:  ctx.RemoteIP().String(),
+            Method:    string(ctx.Method()),
+            Target:    string(ctx.Request.Header.Peek("Sub-URL")), // Replaced by the full URL once known
+            Protocol:  string(ctx.Request.Header.Protocol()),
+            Referer:   string(ctx.Request.Header.Referer()),
+            UserAgent: string(ctx.Request.Header.UserAgent()),
+        },
+        privacy: cfg.GetVisitedLogPrivacy(""),
+        logging: logger,
+        metrics: m,
+    }
+}
+
+// setUser records who sent the request and applies their privacy settings
+func (a *httpAccess) setUser(cfg *config.Config, username, sessionToken, mapping string) {
+    a.entry.User = username
+    a.entry.Session = sessionToken
+    a.entry.Mapping = mapping
+    a.privacy = cfg.GetVisitedLogPrivacy(username)
+}
+
+// countIn wraps a request body stream so that the bytes read from the client are counted
+func (a *httpAccess) countIn(reader io.Reader) io.Reader {
+    return &countingReader{reader: reader, count: &a.bytesIn}
+}
+
+// streamOut wraps a response body stream so that the bytes sent to the client
+// are counted, and the entry is written once the stream is closed
+func (a *httpAccess) streamOut(reader io.Reader) io.Reader {
+    a.streamed = true
+    return &countingReader{reader: reader, count: &a.bytesOut}
+}
+
+// finish writes the entry of a request answered from the handler. The status
+// is taken from the response, streamed responses are finished by close.
+func (a *httpAccess) finish(ctx *fasthttp.RequestCtx) {
+    a.entry.Status = ctx.Response.StatusCode()
+    if a.streamed {
+        return
+    }
+    a.bytesOut.Store(int64(len(ctx.Response.Body())))
+    a.close()
+}
+
+// close writes the entry with the bytes counted so far and records the request in the metrics
+func (a *httpAccess) close() {
+    a.entry.BytesIn = a.bytesIn.Load()
+    a.entry.BytesOut = a.bytesOut.Load()
+    a.entry.Duration = time.Since(a.entry.Time)
+    a.logging.Access(a.entry, a.privacy)
+
+    a.metrics.ProxiedRequests.WithLabelValues(a.entry.Mapping, strconv.Itoa(a.entry.Status)).Inc()
+    a.metrics.BytesTransferred.WithLabelValues("http", "in").Add(float64(a.entry.BytesIn))
+    a.metrics.BytesTransferred.WithLabelValues("http", "out").Add(float64(a.entry.BytesOut))
+}
+
+// countingReader adds the bytes read to a counter
+type countingReader struct {
+    reader io.Reader
+    count  *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+    n, err := r.reader.Read(p)
+    r.count.Add(int64(n))
+    return n, err
+}
+
+// socksAccessKey is the context key of the access log entry of a SOCKS5 CONNECT
+type socksAccessKey struct{}
+
+// socksAccess is the access log entry of a CONNECT request with the privacy settings of its user
+type socksAccess struct {
+    entry   logging.AccessEntry
+    privacy logging.Privacy
+}
+
+// newSOCKSAccess starts the access log entry of a CONNECT request
+func newSOCKSAccess(cfg *config.Config, req *socks5.Request, username string) socksAccess {
+    entry := logging.AccessEntry{
+        Time:     time.Now(),
+        User:     username,
+        Method:   "CONNECT",
+        Target:   net.JoinHostPort(destinationHost(req.DestAddr), strconv.Itoa(req.DestAddr.Port)),
+        Protocol: "SOCKS5",
+    }
+    if req.RemoteAddr != nil {
+        entry.ClientIP = req.RemoteAddr.IP.String()
+    }
+    return socksAccess{entry: entry, privacy: cfg.GetVisitedLogPrivacy(username)}
+}
+
+// withSOCKSAccess returns a context carrying the access log entry of an allowed CONNECT
+func withSOCKSAccess(ctx context.Context, access socksAccess) context.Context {
+    return context.WithValue(ctx, socksAccessKey{}, access)
+}
+
+// AccessDialer connects SOCKS5 clients to their destination and writes the
+// access log entry of each connection: 502 if the dial failed, otherwise 200
+// with the transferred bytes once the connection is closed.
+type AccessDialer struct {
+    dialer  net.Dialer
+    Logging *logging.Logging
+    Metrics *metrics.Metrics
+}
+
+// Dial implements the dial function of the SOCKS5 server config
+func (d *AccessDialer) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+    access, logged := ctx.Value(socksAccessKey{}).(socksAccess)
+
+    conn, err := d.dialer.DialContext(ctx, network, address)
+    if err != nil {
+        if logged {
+            access.entry.Status = fasthttp.StatusBadGateway
+            access.entry.Duration = time.Since(access.entry.Time)
+            d.Logging.Access(access.entry, access.privacy)
+            d.Metrics.SOCKSConnections.WithLabelValues("dial_failed").Inc()
+        }
+        return nil, err
+    }
+    if !logged {
+        return conn, nil
+    }
+    access.entry.Status = fasthttp.StatusOK
+    d.Metrics.SOCKSConnections.WithLabelValues("connected").Inc()
+    d.Metrics.OpenSOCKSConns.Inc()
+    return &accessConn{halfCloseConn: halfCloseConn{conn}, access: access, logging: d.Logging, metrics: d.Metrics}, nil
+}
+
+// accessConn counts the traffic of a SOCKS5 connection on the destination side
+// and writes the access log entry when the connection is closed
+type accessConn struct {
+    halfCloseConn
+    access   socksAccess
+    bytesIn  atomic.Int64 // Written to the destination, received from the client
+    bytesOut atomic.Int64 // Read from the destination, sent to the client
+    once     sync.Once
+    logging  *logging.Logging
+    metrics  *metrics.Metrics
+}
+
+func (c *accessConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.bytesOut.Add(int64(n))
+    return n, err
+}
+
+func (c *accessConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    c.bytesIn.Add(int64(n))
+    return n, err
+}
+
+func (c *accessConn) Close() error {
+    c.once.Do(func() {
+        c.access.entry.BytesIn = c.bytesIn.Load()
+        c.access.entry.BytesOut = c.bytesOut.Load()
+        c.access.entry.Duration = time.Since(c.access.entry.Time)
+        c.logging.Access(c.access.entry, c.access.privacy)
+
+        c.metrics.OpenSOCKSConns.Dec()
+        c.metrics.BytesTransferred.WithLabelValues("socks", "in").Add(float64(c.access.entry.BytesIn))
+        c.metrics.BytesTransferred.WithLabelValues("socks", "out").Add(float64(c.access.entry.BytesOut))
+    })
+    return c.Conn.Close()
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+    "sync"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+// authGuardSweepInterval is how often forgotten failure records are removed
+const authGuardSweepInterval = time.Minute
+
+// guardKey identifies a tracked client IP or username
+type guardKey struct {
+    kind  string // "client_ip" or "user", also the log field name
+    value string
+}
+
+// failureRecord tracks the failed authentications of one client IP or username
+type failureRecord struct {
+    failures    int
+    lastFailure time.Time
+    lockouts    int // Lockouts so far, each one doubles the next
+    lockedUntil time.Time
+    lift        *time.Timer
+}
+
+// AuthGuard protects password authentication against brute force. Client IPs
+// and usernames are tracked separately, and each is locked out for a growing
+// period once it failed too often within the configured window. It is shared
+// by both proxies so that a lockout applies to the handshake and to SOCKS5.
+type AuthGuard struct {
+    records map[guardKey]*failureRecord
+    mutex   sync.Mutex
+    done    chan struct{}
+    now     func() time.Time // The clock, replaced by tests
+    Config  *config.Config
+    Logging *logging.Logging
+}
+
+// NewAuthGuard creates an AuthGuard and starts removing stale records in the background.
+func NewAuthGuard(cfg *config.Config, logging *logging.Logging) *AuthGuard {
+    guard := &AuthGuard{
+        records: make(map[guardKey]*failureRecord),
+        done:    make(chan struct{}),
+        now:     time.Now,
+        Config:  cfg,
+        Logging: logging.Component("auth"),
+    }
+    go guard.sweep()
+    return guard
+}
+
+// Check reports whether the client IP or the username is locked out, and for how much longer.
+func (g *AuthGuard) Check(clientIP, username string) (time.Duration, bool) {
+    if g.Config.GetBruteForce().Disabled {
+        return 0, false
+    }
+
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    now := g.now()
+    var wait time.Duration
+    for _, key := range guardKeys(clientIP, username) {
+        if record, exists := g.records[key]; exists && now.Before(record.lockedUntil) {
+            if remaining := record.lockedUntil.Sub(now); remaining > wait {
+                wait = remaining
+            }
+        }
+    }
+    return wait, wait > 0
+}
+
+// Failure records a failed authentication and starts a lockout once a threshold is reached.
+func (g *AuthGuard) Failure(clientIP, username string) {
+    settings := g.Config.GetBruteForce()
+    if settings.Disabled {
+        return
+    }
+
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    now := g.now()
+    for _, key := range guardKeys(clientIP, username) {
+        maxAttempts := settings.MaxAttemptsPerUser
+        if key.kind == "client_ip" {
+            maxAttempts = settings.MaxAttemptsPerIP
+        }
+
+        record, exists := g.records[key]
+        if !exists {
+            record = &failureRecord{}
+            g.records[key] = record
+        }
+        if now.Before(record.lockedUntil) {
+            continue
+        }
+        if now.Sub(record.lastFailure) > time.Duration(settings.Window) {
+            record.failures = 0
+        }
+        record.failures++
+        record.lastFailure = now
+
+        if record.failures >= maxAttempts {
+            g.lockOut(key, record, settings, now)
+        }
+    }
+}
+
+// Success forgets the failures of a client IP and username after a successful authentication.
+func (g *AuthGuard) Success(clientIP, username string) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    now := g.now()
+    for _, key := range guardKeys(clientIP, username) {
+        if record, exists := g.records[key]; exists && !now.Before(record.lockedUntil) {
+            delete(g.records, key)
+        }
+    }
+}
+
+// Close stops the background sweep and pending lift notices.
+func (g *AuthGuard) Close() {
+    close(g.done)
+
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    for _, record := range g.records {
+        if record.lift != nil {
+            record.lift.Stop()
+        }
+    }
+}
+
+// lockOut starts a lockout whose length doubles with every previous one. The caller must hold the lock.
+func (g *AuthGuard) lockOut(key guardKey, record *failureRecord, settings config.BruteForceConfig, now time.Time) {
+    maxLockout := time.Duration(settings.MaxLockout)
+    if lockout := time.Duration(settings.Lockout); maxLockout < lockout {
+        maxLockout = lockout
+    }
+    duration := time.Duration(settings.Lockout)
+    for i := 0; i < record.lockouts && duration < maxLockout; i++ {
+        duration *= 2
+    }
+    if duration > maxLockout {
+        duration = maxLockout
+    }
+
+    g.Logging.Warn("Lockout started after repeated failed authentications", key.kind, key.value, "duration", duration, "failures", record.failures)
+    record.failures = 0
+    record.lockouts++
+    record.lockedUntil = now.Add(duration)
+    record.lift = time.AfterFunc(duration, func() {
+        g.Logging.Info("Lockout lifted", key.kind, key.value)
+    })
+}
+
+// sweep removes records that neither hold a lockout nor had a failure within the window
+func (g *AuthGuard) sweep() {
+    ticker := time.NewTicker(authGuardSweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-g.done:
+            return
+        case <-ticker.C:
+        }
+
+        window := time.Duration(g.Config.GetBruteForce().Window)
+        g.mutex.Lock()
+        now := g.now()
+        for key, record := range g.records {
+            lastEvent := record.lastFailure
+            if record.lockedUntil.After(lastEvent) {
+                lastEvent = record.lockedUntil
+            }
+            if now.Sub(lastEvent) > window {
+                delete(g.records, key)
+            }
+        }
+        g.mutex.Unlock()
+    }
+}
+
+// guardKeys returns the records an authentication attempt counts against
+func guardKeys(clientIP, username string) []guardKey {
+    keys := []guardKey{{kind: "client_ip", value: clientIP}}
+    if username != "" {
+        keys = append(keys, guardKey{kind: "user", value: username})
+    }
+    return keys
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "golang.org/x/net/proxy"
+)
+
+// guardAttempt is a failed authentication, made after the clock moved on by wait
+type guardAttempt struct {
+    wait     time.Duration
+    clientIP string
+    username string
+}
+
+func TestAuthGuard(t *testing.T) {
+    settings := config.BruteForceConfig{
+        MaxAttemptsPerIP:   3,
+        MaxAttemptsPerUser: 2,
+        Window:             config.Duration(time.Minute),
+        Lockout:            config.Duration(10 * time.Second),
+        MaxLockout:         config.Duration(15 * time.Second),
+    }
+    for _, test := range []struct {
+        name     string
+        failures []guardAttempt
+        wait     time.Duration // Before the check
+        check    guardAttempt
+        want     time.Duration
+    }{
+        {
+            name:     "below the thresholds",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}},
+            check:    guardAttempt{0, "10.0.0.1", "alice"},
+        },
+        {
+            name:     "per-IP threshold",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {0, "10.0.0.1", "bob"}, {0, "10.0.0.1", "carol"}},
+            check:    guardAttempt{0, "10.0.0.1", "dave"},
+            want:     10 * time.Second,
+        },
+        {
+            name:     "per-user threshold",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {0, "10.0.0.2", "alice"}},
+            check:    guardAttempt{0, "10.0.0.3", "alice"},
+            want:     10 * time.Second,
+        },
+        {
+            name:     "other clients stay unlocked",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {0, "10.0.0.1", "alice"}},
+            check:    guardAttempt{0, "10.0.0.2", "bob"},
+        },
+        {
+            name:     "remaining lockout",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {0, "10.0.0.2", "alice"}},
+            wait:     4 * time.Second,
+            check:    guardAttempt{0, "10.0.0.3", "alice"},
+            want:     6 * time.Second,
+        },
+        {
+            name:     "window reset",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {time.Minute + time.Second, "10.0.0.2", "alice"}},
+            check:    guardAttempt{0, "10.0.0.3", "alice"},
+        },
+        {
+            name:     "lockout expired",
+            failures: []guardAttempt{{0, "10.0.0.1", "alice"}, {0, "10.0.0.2", "alice"}},
+            wait:     10 * time.Second,
+            check:    guardAttempt{0, "10.0.0.3", "alice"},
+        },
+        {
+            name: "failures during a lockout do not count",
+            failures: []guardAttempt{
+                {0, "10.0.0.1", "alice"}, {0, "10.0.0.2", "alice"},
+                {time.Second, "10.0.0.3", "alice"}, {0, "10.0.0.4", "alice"},
+                {9 * time.Second, "10.0.0.5", "alice"},
+            },
+            check: guardAttempt{0, "10.0.0.6", "alice"},
+        },
+        {
+            name: "second lockout doubles up to the maximum",
+            failures: []guardAttempt{
+                {0, "10.0.0.1", "alice"}, {0, "10.0.0.2", "alice"},
+                {10 * time.Second, "10.0.0.3", "alice"}, {0, "10.0.0.4", "alice"},
+            },
+            check: guardAttempt{0, "10.0.0.5", "alice"},
+            want:  15 * time.Second,
+        },
+    } {
+        t.Run(test.name, func(t *testing.T) {
+            cfg := &config.Config{BruteForce: settings}
+            logger := logging.New(false)
+            logger.Configure(logging.Settings{Level: "error"})
+            guard := NewAuthGuard(cfg, logger)
+            defer guard.Close()
+            now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+            guard.now = func() time.Time { return now }
+
+            for _, failure := range test.failures {
+                now = now.Add(failure.wait)
+                guard.Failure(failure.clientIP, failure.username)
+            }
+            now = now.Add(test.wait)
+            wait, locked := guard.Check(test.check.clientIP, test.check.username)
+            if wait != test.want || locked != (test.want > 0) {
+                t.Errorf("Check = %s, %v, want %s", wait, locked, test.want)
+            }
+        })
+    }
+}
+
+func TestAuthGuardSuccessForgetsFailures(t *testing.T) {
+    cfg := &config.Config{BruteForce: config.BruteForceConfig{MaxAttemptsPerIP: 2, MaxAttemptsPerUser: 2, Window: config.Duration(time.Minute), Lockout: config.Duration(time.Minute)}}
+    logger := logging.New(false)
+    logger.Configure(logging.Settings{Level: "error"})
+    guard := NewAuthGuard(cfg, logger)
+    defer guard.Close()
+
+    guard.Failure("10.0.0.1", "alice")
+    guard.Success("10.0.0.1", "alice")
+    guard.Failure("10.0.0.1", "alice")
+    if wait, locked := guard.Check("10.0.0.1", "alice"); locked {
+        t.Errorf("Check = %s, want no lockout after a success", wait)
+    }
+}
+
+// lockingConfig locks alice and her client IP out after two failures
+func lockingConfig(cfg *config.Config) *config.Config {
+    cfg.BruteForce = config.BruteForceConfig{
+        MaxAttemptsPerIP:   2,
+        MaxAttemptsPerUser: 2,
+        Window:             config.Duration(time.Minute),
+        Lockout:            config.Duration(90 * time.Second),
+    }
+    return cfg
+}
+
+func TestHandshakeLockout(t *testing.T) {
+    upstream := startRecordingUpstream(t, nil)
+    address := newProxyFixture(t, lockingConfig(newHTTPTestConfig(upstream.URL))).serveHTTP(t)
+
+    for _, test := range []struct {
+        password string
+        want     int
+    }{
+        {"wrong", http.StatusUnauthorized},
+        {"wrong", http.StatusUnauthorized},
+        {"secret", http.StatusTooManyRequests},
+    } {
+        req, err := http.NewRequest(http.MethodPost, "http://"+address+"/handshake", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header.Set("Username", "alice")
+        req.Header.Set("Password", test.password)
+        req.Header.Set("Domain-Name", "upstream")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != test.want {
+            t.Fatalf("handshake with %q = %d, want %d", test.password, resp.StatusCode, test.want)
+        }
+        if test.want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "90" {
+            t.Errorf("Retry-After = %q, want \"90\"", resp.Header.Get("Retry-After"))
+        }
+    }
+}
+
+func TestSOCKS5Lockout(t *testing.T) {
+    echo := startEchoServer(t)
+    address := newProxyFixture(t, lockingConfig(newSOCKSTestConfig(echo))).serveSOCKS5(t)
+
+    for _, password := range []string{"wrong", "wrong", "secret"} {
+        dialer, err := proxy.SOCKS5("tcp", address, &proxy.Auth{User: "alice", Password: password}, proxy.Direct)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if conn, err := dialer.Dial("tcp", echo.Addr().String()); err == nil {
+            conn.Close()
+            t.Fatalf("Dial with password %q succeeded, want a lockout after two failures", password)
+        }
+    }
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+    "errors"
+    "io"
+
+    "github.com/valyala/fasthttp"
+)
+
+var (
+    ErrBodyTooLarge = errors.New("body exceeds the maximum allowed size")
+)
+
+// limitedReader passes data through until more than max bytes were read.
+// A max of zero or less disables the limit.
+type limitedReader struct {
+    reader io.Reader
+    max    int64
+    read   int64
+}
+
+func newLimitedReader(reader io.Reader, max int64) *limitedReader {
+    return &limitedReader{reader: reader, max: max}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+    if l.max <= 0 {
+        return l.reader.Read(p)
+    }
+    if l.read > l.max {
+        return 0, ErrBodyTooLarge
+    }
+
+    n, err := l.reader.Read(p)
+    l.read += int64(n)
+    if l.read > l.max {
+        // Only pass on the bytes that still fit into the limit
+        return n - int(l.read-l.max), ErrBodyTooLarge
+    }
+    return n, err
+}
+
+// maxDiscardedBodySize is how much of an unread request body is skipped to
+// keep the connection open, larger bodies close the connection instead
+const maxDiscardedBodySize = 64 * 1024
+
+// discardRequestBody consumes what a handler left unread of a streamed request
+// body. Refused requests are answered without reading their body, and the
+// remaining bytes would otherwise be parsed as the next request on the
+// keep-alive connection.
+func discardRequestBody(ctx *fasthttp.RequestCtx) {
+    bodyStream := ctx.RequestBodyStream()
+    if bodyStream == nil {
+        return
+    }
+    n, err := io.Copy(io.Discard, io.LimitReader(bodyStream, maxDiscardedBodySize+1))
+    if err != nil || n > maxDiscardedBodySize {
+        ctx.SetConnectionClose()
+    }
+}
+
+// responseStream streams an upstream response body through reader and
+// releases the upstream response once the client side is done with it.
+type responseStream struct {
+    io.Reader
+    resp *fasthttp.Response
+    done func() // Called after the response was released
+}
+
+func newResponseStream(resp *fasthttp.Response, reader io.Reader, done func()) *responseStream {
+    return &responseStream{
+        Reader: reader,
+        resp:   resp,
+        done:   done,
+    }
+}
+
+// Close is called by fasthttp after the body has been written to the client
+func (s *responseStream) Close() error {
+    err := s.resp.CloseBodyStream()
+    fasthttp.ReleaseResponse(s.resp)
+    s.done()
+    return err
+}
+
+// streamSize converts a fasthttp content length to a body stream size.
+// Chunked (-1) and read-until-close (-2) bodies are both sent chunked.
+func streamSize(contentLength int) int {
+    if contentLength < 0 {
+        return -1
+    }
+    return contentLength
+}
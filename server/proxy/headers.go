@@ -0,0 +1,67 @@
+package proxy
+
+import (
+    "strings"
+
+    "github.com/valyala/fasthttp"
+)
+
+// proxyHeaders control the proxy itself and must never reach the upstream server.
+// Session-Token would let the upstream replay the client's session.
+var proxyHeaders = []string{
+    "Session-Token",
+    "Sub-URL",
+    "Username",
+    "Password",
+    "Domain-Name",
+    "Revoke-User",
+    "Revoke-Token",
+}
+
+// hopByHopHeaders only apply to the connection between the client and the proxy.
+// Transfer-Encoding of requests is left to fasthttp, which sets it from the body stream.
+var hopByHopHeaders = []string{
+    "Connection",
+    "Keep-Alive",
+    "Proxy-Connection",
+    "Proxy-Authenticate",
+    "Proxy-Authorization",
+    "TE",
+    "Trailer",
+    "Upgrade",
+}
+
+// headerDeleter is the part of the request and response headers stripping needs
+type headerDeleter interface {
+    Peek(key string) []byte
+    Del(key string)
+}
+
+// stripProxyHeaders removes the proxy-control and hop-by-hop headers from a
+// request about to be forwarded, including the ones listed in Connection.
+func stripProxyHeaders(header *fasthttp.RequestHeader) {
+    stripHopByHopHeaders(header)
+    for _, name := range proxyHeaders {
+        header.Del(name)
+    }
+}
+
+// stripResponseHeaders removes the hop-by-hop headers from an upstream response
+// about to be sent to the client. Transfer-Encoding goes too, fasthttp frames
+// the streamed body for the client connection itself.
+func stripResponseHeaders(header *fasthttp.ResponseHeader) {
+    stripHopByHopHeaders(header)
+    header.Del(fasthttp.HeaderTransferEncoding)
+}
+
+// stripHopByHopHeaders removes the hop-by-hop headers, including the ones listed in Connection
+func stripHopByHopHeaders(header headerDeleter) {
+    for _, name := range strings.Split(string(header.Peek(fasthttp.HeaderConnection)), ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            header.Del(name)
+        }
+    }
+    for _, name := range hopByHopHeaders {
+        header.Del(name)
+    }
+}
@@ -1,100 +1,390 @@
 package proxy
 
 import (
+    "context"
     "crypto/tls"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math"
+    "net"
+    "strconv"
     "strings"
+    "sync"
     "time"
 
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
     "github.com/valyala/fasthttp"
 )
 
-func StartHTTPProxy(cfg *config.Config, logger *logging.Logging, sessionStore *session.SessionStore) {
-    logger.Logln("Starting HTTP proxy on :8080")
-    if err := fasthttp.ListenAndServe(":8080", func(ctx *fasthttp.RequestCtx) {
-        requestHandler(ctx, cfg, logger, sessionStore)
-    }); err != nil {
-        logger.Fatalf("Error in ListenAndServe: %s", err)
+// HTTPProxy serves the handshake endpoint and proxies requests of established sessions.
+type HTTPProxy struct {
+    server    *fasthttp.Server
+    upstreams *UpstreamPool
+    reloader  *CertReloader
+    listener  net.Listener
+    closing   bool
+    mutex     sync.Mutex
+    done      chan struct{}
+    Config    *config.Config
+    Logging   *logging.Logging
+}
+
+// NewHTTPProxy creates the HTTP proxy, it starts serving with ListenAndServe.
+func NewHTTPProxy(cfg *config.Config, logger *logging.Logging, sessionStore session.SessionStore, guard *AuthGuard, trafficControl *TrafficControl, m *metrics.Metrics) *HTTPProxy {
+    logger = logger.Component("http")
+    upstreams := NewUpstreamPool(logger)
+    return &HTTPProxy{
+        server: &fasthttp.Server{
+            Handler: func(ctx *fasthttp.RequestCtx) {
+                requestHandler(ctx, cfg, logger, sessionStore, guard, trafficControl, upstreams, m)
+            },
+            Logger: logger.FilteredStdLogger(slog.LevelWarn, httpLogFilter),
+            // Hand request bodies to the handler as a stream instead of buffering them
+            StreamRequestBody: true,
+            // Tell keep-alive clients to reconnect elsewhere once shutdown started
+            CloseOnShutdown: true,
+        },
+        upstreams: upstreams,
+        done:      make(chan struct{}),
+        Config:    cfg,
+        Logging:   logger,
     }
 }
 
-func requestHandler(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore *session.SessionStore) {
-    path := string(ctx.Path())
-    if path == "/handshake" {
-        handleHandshake(ctx, cfg, logger, sessionStore)
+// ListenAndServe listens on the configured address and blocks until Shutdown is called.
+func (p *HTTPProxy) ListenAndServe() error {
+    settings := p.Config.GetListeners().HTTP
+
+    listener, err := net.Listen("tcp", settings.Address)
+    if err != nil {
+        return fmt.Errorf("failed to listen on %s: %w", settings.Address, err)
+    }
+
+    // Wrap the listener in TLS so that handshake credentials are not sent in the clear
+    if settings.TLS.Enabled() {
+        p.reloader, err = NewCertReloader(settings.TLS, p.Logging)
+        if err != nil {
+            listener.Close()
+            return fmt.Errorf("failed to load TLS certificate: %w", err)
+        }
+        go p.reloader.Watch(p.done)
+        listener = tls.NewListener(listener, p.reloader.TLSConfig())
+        p.Logging.Info("Starting HTTPS proxy", "address", settings.Address)
     } else {
-        handleProxyRequest(ctx, cfg, logger, sessionStore)
+        p.Logging.Info("Starting HTTP proxy", "address", settings.Address)
     }
+
+    // fasthttp ignores a shutdown that comes before Serve, so Shutdown closes the listener too
+    p.mutex.Lock()
+    if p.closing {
+        p.mutex.Unlock()
+        listener.Close()
+        return nil
+    }
+    p.listener = &onceCloseListener{Listener: listener}
+    p.mutex.Unlock()
+
+    go p.pruneUpstreamsOnReload(p.Config.Subscribe())
+    return p.server.Serve(p.listener)
 }
 
-func handleHandshake(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore *session.SessionStore) {
-    // Read authentication info from the request
+// pruneUpstreamsOnReload drops the upstream clients of removed mappings after every reload
+func (p *HTTPProxy) pruneUpstreamsOnReload(reloads <-chan struct{}) {
+    for {
+        select {
+        case <-p.done:
+            return
+        case <-reloads:
+            p.upstreams.Prune(p.Config)
+        }
+    }
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx expires,
+// remaining connections are closed after that.
+func (p *HTTPProxy) Shutdown(ctx context.Context) error {
+    p.mutex.Lock()
+    if p.closing {
+        p.mutex.Unlock()
+        return nil
+    }
+    p.closing = true
+    if p.listener != nil {
+        p.listener.Close()
+    }
+    p.mutex.Unlock()
+
+    close(p.done)
+    return p.server.ShutdownWithContext(ctx)
+}
+
+// onceCloseListener only closes the listener on the first call, later calls
+// return the first result. Both Shutdown and fasthttp close it.
+type onceCloseListener struct {
+    net.Listener
+    once sync.Once
+    err  error
+}
+
+func (l *onceCloseListener) Close() error {
+    l.once.Do(func() {
+        l.err = l.Listener.Close()
+    })
+    return l.err
+}
+
+func requestHandler(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore session.SessionStore, guard *AuthGuard, trafficControl *TrafficControl, upstreams *UpstreamPool, m *metrics.Metrics) {
+    // Whatever the handler left of a streamed body must not be read as the next request
+    defer discardRequestBody(ctx)
+
+    logger = logger.With("client_ip", ctx.RemoteIP().String())
+    path := string(ctx.Path())
+    switch path {
+    case "/handshake":
+        handleHandshake(ctx, cfg, logger, sessionStore, guard, m)
+    case "/logout":
+        handleLogout(ctx, logger, sessionStore)
+    case "/admin/revoke":
+        handleAdminRevoke(ctx, cfg, logger, sessionStore, guard, m)
+    default:
+        handleProxyRequest(ctx, cfg, logger, sessionStore, trafficControl, upstreams, m)
+    }
+}
+
+// authenticateRequest checks the Username and Password headers of a request,
+// refusing locked out clients with 429 and wrong credentials with 401.
+// It returns the authenticated username.
+func authenticateRequest(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, guard *AuthGuard, m *metrics.Metrics, purpose string) (string, bool) {
     username := string(ctx.Request.Header.Peek("Username"))
     password := string(ctx.Request.Header.Peek("Password"))
-    domainName := string(ctx.Request.Header.Peek("Domain-Name"))
+    clientIP := ctx.RemoteIP().String()
+
+    if wait, locked := guard.Check(clientIP, username); locked {
+        logger.Warn("Refused locked out client", "purpose", purpose, "user", username, "retry_after", wait.Round(time.Second))
+        m.AuthFailures.WithLabelValues("http", "locked_out").Inc()
+        tooManyRequests(ctx, "Too many failed attempts", wait)
+        return "", false
+    }
 
-    // Authenticate user
     if !cfg.AuthenticateUser(username, password) {
-        logger.Logln("Authentication failed during handshake")
+        guard.Failure(clientIP, username)
+        logger.Warn("Authentication failed", "purpose", purpose, "user", username)
+        m.AuthFailures.WithLabelValues("http", "invalid_credentials").Inc()
         ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+        return "", false
+    }
+    guard.Success(clientIP, username)
+    return username, true
+}
+
+// tooManyRequests answers 429 and tells the client when to retry
+func tooManyRequests(ctx *fasthttp.RequestCtx, message string, wait time.Duration) {
+    ctx.Error(message, fasthttp.StatusTooManyRequests)
+    // Set after Error, which resets the response headers
+    ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+func handleHandshake(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore session.SessionStore, guard *AuthGuard, m *metrics.Metrics) {
+    defer func() {
+        m.Handshakes.WithLabelValues(handshakeResult(ctx.Response.StatusCode())).Inc()
+    }()
+
+    // Authenticate user
+    username, ok := authenticateRequest(ctx, cfg, logger, guard, m, "handshake")
+    if !ok {
         return
     }
-    logger.Logf("User '%s' authenticated successfully", username)
+    domainName := string(ctx.Request.Header.Peek("Domain-Name"))
+    logger = logger.With("user", username, "domain", domainName)
+    logger.Debug("User authenticated")
 
     // Get target domain for the domain name
     targetDomain, exists := cfg.GetTargetDomain(domainName)
     if !exists {
-        logger.Logf("Domain not found during handshake: %s", domainName)
+        logger.Warn("Domain not found during handshake")
         ctx.Error("Domain not found", fasthttp.StatusNotFound)
         return
     }
-    logger.Logf("Target domain for handshake: %s", targetDomain)
+    logger = logger.With("target", targetDomain)
+
+    // Check the user's domain policy
+    if !cfg.AuthorizeDomain(username, domainName) {
+        logger.Warn("User is not allowed to access the domain")
+        ctx.Error("Forbidden", fasthttp.StatusForbidden)
+        return
+    }
 
-    // Create a new session
-    sessionToken := sessionStore.CreateSession(username, targetDomain)
-    logger.Logf("Session created with token: %s", sessionToken)
+    // Create a new session within the user's session quota
+    idleTimeout, maxLifetime := cfg.GetSessionLimits(username)
+    maxSessions, policy := cfg.GetSessionQuota(username)
+    sessionToken, evicted, err := sessionStore.CreateSession(username, domainName, targetDomain, ctx.RemoteIP().String(),
+        session.Limits{IdleTimeout: idleTimeout, MaxLifetime: maxLifetime},
+        session.Quota{Max: maxSessions, EvictOldest: policy == config.SessionLimitEvictOldest})
+    if errors.Is(err, session.ErrTooManySessions) {
+        logger.Warn("Session limit reached, handshake refused", "max_sessions", maxSessions)
+        ctx.Error("Too many sessions", fasthttp.StatusConflict)
+        return
+    }
+    if evicted > 0 {
+        logger.Info("Evicted oldest sessions to stay within the session limit", "evicted", evicted, "max_sessions", maxSessions)
+        ctx.Response.Header.Set("Evicted-Sessions", strconv.Itoa(evicted))
+    }
+    logger.Info("Session created", "session", sessionToken)
 
     // Return the session token to the client
     ctx.Response.Header.Set("Session-Token", sessionToken)
     ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
-func handleProxyRequest(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logger, sessionStore *session.SessionStore) {
+// handshakeResult names the outcome of a handshake for the metrics
+func handshakeResult(status int) string {
+    switch status {
+    case fasthttp.StatusOK:
+        return "success"
+    case fasthttp.StatusUnauthorized:
+        return "unauthorized"
+    case fasthttp.StatusTooManyRequests:
+        return "locked_out"
+    case fasthttp.StatusNotFound:
+        return "unknown_domain"
+    case fasthttp.StatusForbidden:
+        return "forbidden"
+    case fasthttp.StatusConflict:
+        return "session_limit"
+    default:
+        return "error"
+    }
+}
+
+// handleLogout ends the caller's session. Like proxied requests it must come
+// from the IP the session was created from.
+func handleLogout(ctx *fasthttp.RequestCtx, logger *logging.Logging, sessionStore session.SessionStore) {
+    sessionToken := string(ctx.Request.Header.Peek("Session-Token"))
+    if sessionToken == "" {
+        logger.Warn("Session token missing in logout")
+        ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+        return
+    }
+
+    session, exists := sessionStore.Lookup(sessionToken)
+    if !exists {
+        logger.Warn("Logout with invalid or expired session token", "session", sessionToken)
+        ctx.Error("Session not found or expired", fasthttp.StatusUnauthorized)
+        return
+    }
+
+    clientIP := ctx.RemoteIP().String()
+    if clientIP != session.ClientIP {
+        logger.Warn("Logout from an IP that does not match the session IP", "session", sessionToken, "session_ip", session.ClientIP)
+        ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+        return
+    }
+
+    sessionStore.Revoke(sessionToken)
+    logger.Info("User logged out", "user", session.Username, "session", sessionToken)
+    ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// handleAdminRevoke lets an admin user end sessions. The admin authenticates
+// like a handshake and names either a user (Revoke-User) whose sessions are
+// all ended, or a single token (Revoke-Token).
+func handleAdminRevoke(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore session.SessionStore, guard *AuthGuard, m *metrics.Metrics) {
+    username, ok := authenticateRequest(ctx, cfg, logger, guard, m, "session revocation")
+    if !ok {
+        return
+    }
+    if !cfg.IsAdmin(username) {
+        logger.Warn("User is not allowed to revoke sessions", "user", username)
+        ctx.Error("Forbidden", fasthttp.StatusForbidden)
+        return
+    }
+
+    revokeUser := string(ctx.Request.Header.Peek("Revoke-User"))
+    revokeToken := string(ctx.Request.Header.Peek("Revoke-Token"))
+    switch {
+    case revokeUser != "":
+        revoked := sessionStore.RevokeUser(revokeUser)
+        logger.Info("Admin revoked the sessions of a user", "admin", username, "user", revokeUser, "revoked", revoked)
+        ctx.SetBodyString(fmt.Sprintf("Revoked the sessions of user '%s'", revokeUser))
+    case revokeToken != "":
+        if !sessionStore.Revoke(revokeToken) {
+            logger.Warn("Admin tried to revoke an unknown session", "admin", username, "session", revokeToken)
+            ctx.Error("Session not found or expired", fasthttp.StatusNotFound)
+            return
+        }
+        logger.Info("Admin revoked a session", "admin", username, "session", revokeToken)
+        ctx.SetBodyString("Session revoked")
+    default:
+        ctx.Error("Bad Request: Revoke-User or Revoke-Token missing", fasthttp.StatusBadRequest)
+        return
+    }
+    ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func handleProxyRequest(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *logging.Logging, sessionStore session.SessionStore, trafficControl *TrafficControl, upstreams *UpstreamPool, m *metrics.Metrics) {
+    // Every request except keep-alives ends up in the access log, refused ones included
+    access := newHTTPAccess(ctx, cfg, logger, m)
+    keepAlive := string(ctx.Request.Header.Peek("Keep-Alive")) == "true"
+    if !keepAlive {
+        defer access.finish(ctx)
+    }
+
     // Get session token from request header
     sessionToken := string(ctx.Request.Header.Peek("Session-Token"))
     if sessionToken == "" {
-        logger.Logln("Session token missing in request")
+        logger.Warn("Session token missing in request")
         ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
         return
     }
 
     // Retrieve session
-    session, exists := sessionStore.GetSession(sessionToken)
+    session, exists := sessionStore.Lookup(sessionToken)
     if !exists {
-        logger.Logf("Invalid or expired session token: %s", sessionToken)
+        logger.Warn("Invalid or expired session token", "session", sessionToken)
         ctx.Error("Session not found or expired", fasthttp.StatusUnauthorized)
         return
     }
 
+    logger = logger.With("session", sessionToken, "user", session.Username, "target", session.TargetDomain)
+    access.setUser(cfg, session.Username, sessionToken, session.DomainName)
+
     // Validate client IP
     clientIP := ctx.RemoteIP().String()
     if clientIP != session.ClientIP {
-        logger.Logf("Request from IP '%s' does not match session IP '%s'", clientIP, session.ClientIP)
+        logger.Warn("Request from an IP that does not match the session IP", "session_ip", session.ClientIP)
         ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
         return
     }
 
     // Update session last active time
-    session.LastActive = time.Now()
-    logger.Logf("Session '%s' accessed by user '%s'", sessionToken, session.Username)
+    session, exists = sessionStore.Touch(sessionToken)
+    if !exists {
+        logger.Warn("Invalid or expired session token", "session", sessionToken)
+        ctx.Error("Session not found or expired", fasthttp.StatusUnauthorized)
+        return
+    }
+    logger.Debug("Session accessed")
 
     // Handle keep-alive messages
-    if string(ctx.Request.Header.Peek("Keep-Alive")) == "true" {
+    if keepAlive {
         ctx.SetStatusCode(fasthttp.StatusOK)
         ctx.SetBodyString("Keep-alive acknowledged")
-        logger.Logf("Keep-alive message received from session '%s'", sessionToken)
+        logger.Debug("Keep-alive message received")
+        return
+    }
+
+    // Enforce the user's request rate and traffic quota
+    if wait, err := trafficControl.Admit(session.Username, sessionToken); err != nil {
+        logger.Warn("Request refused by traffic limits", "error", err, "retry_after", wait.Round(time.Second))
+        if errors.Is(err, ErrQuotaExceeded) {
+            tooManyRequests(ctx, "Traffic quota exceeded", wait)
+        } else {
+            tooManyRequests(ctx, "Too many requests", wait)
+        }
         return
     }
 
@@ -102,50 +392,117 @@ func handleProxyRequest(ctx *fasthttp.RequestCtx, cfg *config.Config, logger *lo
     // Extract the sub-URL from the header
     subURL := string(ctx.Request.Header.Peek("Sub-URL"))
     if subURL == "" {
-        logger.Logln("Sub-URL missing in request")
+        logger.Warn("Sub-URL missing in request")
         ctx.Error("Bad Request: Sub-URL missing", fasthttp.StatusBadRequest)
         return
     }
 
     // Construct the full target URL
+    // The URL is only logged as far as the user's privacy settings allow
     fullURL := joinURL(session.TargetDomain, subURL)
-    logger.Printf("Proxying request to: %s", fullURL)
+    if address, recorded := access.privacy.Address(fullURL); recorded {
+        logger = logger.With("url", address)
+    }
+    access.entry.Target = fullURL
+    logger.Debug("Proxying request")
+
+    // Reject bodies that announce a size above the limit before contacting upstream
+    maxBodySize := cfg.GetMaxBodySize()
+    if maxBodySize > 0 && int64(ctx.Request.Header.ContentLength()) > maxBodySize {
+        logger.Warn("Request body exceeds the size limit", "size", ctx.Request.Header.ContentLength(), "limit", maxBodySize)
+        ctx.Error("Request body too large", fasthttp.StatusRequestEntityTooLarge)
+        return
+    }
 
     // Prepare the proxy request
     req := fasthttp.AcquireRequest()
-    resp := fasthttp.AcquireResponse()
     defer fasthttp.ReleaseRequest(req)
-    defer fasthttp.ReleaseResponse(resp)
 
-    // Copy the method and headers from the client request
+    // Copy the method and headers from the client request, except the ones meant for the proxy
     req.Header.SetMethodBytes(ctx.Method())
     ctx.Request.Header.CopyTo(&req.Header)
+    stripProxyHeaders(&req.Header)
     req.SetRequestURI(fullURL)
 
-    // Create a client for proxying the request
-    client := &fasthttp.Client{
-        ReadTimeout:  10 * time.Second,
-        WriteTimeout: 10 * time.Second,
-        TLSConfig: &tls.Config{
-            InsecureSkipVerify: true, // Note: For testing purposes only
-        },
+    // Stream the request body upstream, chunked if the client sent it chunked
+    if contentLength := ctx.Request.Header.ContentLength(); contentLength != 0 {
+        if bodyStream := ctx.RequestBodyStream(); bodyStream != nil {
+            body := access.countIn(newLimitedReader(bodyStream, maxBodySize))
+            req.SetBodyStream(trafficControl.Reader(session.Username, body), streamSize(contentLength))
+        } else {
+            access.bytesIn.Add(int64(len(ctx.Request.Body())))
+            trafficControl.Transfer(session.Username, len(ctx.Request.Body()))
+            req.SetBody(ctx.Request.Body())
+        }
+    }
+
+    // Get the pooled client for the session's domain mapping
+    mapping, exists := cfg.GetMapping(session.DomainName)
+    if !exists {
+        logger.Warn("Domain of the session no longer exists", "domain", session.DomainName)
+        ctx.Error("Domain not found", fasthttp.StatusNotFound)
+        return
+    }
+    client, err := upstreams.Get(mapping, cfg.GetUpstreamIdleTimeout())
+    if err != nil {
+        logger.Error("Failed to create upstream client", "domain", mapping.From, "error", err)
+        ctx.Error("Error when proxying the request", fasthttp.StatusBadGateway)
+        return
     }
 
     // Perform the request to the target server
-    if err := client.Do(req, resp); err != nil {
-        logger.Logf("Error when proxying the request: %s", err)
+    resp := fasthttp.AcquireResponse()
+    start := time.Now()
+    err = client.Do(req, resp)
+    m.UpstreamLatency.WithLabelValues(mapping.From).Observe(time.Since(start).Seconds())
+    if err != nil {
+        fasthttp.ReleaseResponse(resp)
+        logger.Error("Error when proxying the request", "error", err)
+        if errors.Is(err, ErrBodyTooLarge) {
+            ctx.Error("Request body too large", fasthttp.StatusRequestEntityTooLarge)
+            return
+        }
+        if errors.Is(err, ErrQuotaExceeded) {
+            ctx.Error("Traffic quota exceeded", fasthttp.StatusTooManyRequests)
+            return
+        }
         ctx.Error("Error when proxying the request", fasthttp.StatusBadGateway)
         return
     }
 
-    // Copy the response from the target server to the client
+    if maxBodySize > 0 && int64(resp.Header.ContentLength()) > maxBodySize {
+        logger.Warn("Response body exceeds the size limit", "size", resp.Header.ContentLength(), "limit", maxBodySize)
+        resp.CloseBodyStream()
+        fasthttp.ReleaseResponse(resp)
+        ctx.Error("Response body too large", fasthttp.StatusBadGateway)
+        return
+    }
+
+    // Copy the response from the target server to the client, the body is
+    // streamed and the upstream response released once it has been sent
     resp.Header.CopyTo(&ctx.Response.Header)
+    stripResponseHeaders(&ctx.Response.Header)
     ctx.SetStatusCode(resp.StatusCode())
-    ctx.SetBody(resp.Body())
-    logger.Logf("Response sent to client with status code: %d", resp.StatusCode())
+    if resp.BodyStream() != nil {
+        body := access.streamOut(trafficControl.Reader(session.Username, newLimitedReader(resp.BodyStream(), maxBodySize)))
+        ctx.SetBodyStream(newResponseStream(resp, body, access.close), streamSize(resp.Header.ContentLength()))
+    } else {
+        trafficControl.Transfer(session.Username, len(resp.Body()))
+        ctx.SetBody(resp.Body())
+        fasthttp.ReleaseResponse(resp)
+    }
+    logger.Info("Response sent to client", "status", ctx.Response.StatusCode())
 }
 
-
 func joinURL(baseURL, subaddress string) string {
     return strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(subaddress, "/")
 }
+
+// httpLogFilter cuts the request snippet from fasthttp's messages about
+// malformed requests, it holds raw headers like Password and Session-Token.
+func httpLogFilter(message string) (string, bool) {
+    if i := strings.Index(message, ", contents: "); i >= 0 {
+        message = message[:i]
+    }
+    return message, true
+}
@@ -0,0 +1,483 @@
+package proxy
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+)
+
+// recordingUpstream is an upstream server that remembers the requests it received
+type recordingUpstream struct {
+    *httptest.Server
+    requests []*http.Request
+    mutex    sync.Mutex
+}
+
+func startRecordingUpstream(t *testing.T, handler http.HandlerFunc) *recordingUpstream {
+    t.Helper()
+    upstream := &recordingUpstream{}
+    upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        upstream.mutex.Lock()
+        upstream.requests = append(upstream.requests, r)
+        upstream.mutex.Unlock()
+        if handler != nil {
+            handler(w, r)
+        }
+    }))
+    t.Cleanup(upstream.Close)
+    return upstream
+}
+
+// paths returns the paths of the requests received so far
+func (u *recordingUpstream) paths() []string {
+    u.mutex.Lock()
+    defer u.mutex.Unlock()
+    paths := make([]string, len(u.requests))
+    for i, r := range u.requests {
+        paths[i] = r.URL.Path
+    }
+    return paths
+}
+
+// newHTTPTestConfig lets alice open sessions for the upstream under the mapping "upstream"
+func newHTTPTestConfig(upstreamURL string) *config.Config {
+    return &config.Config{
+        UserCredentials: []config.UserCredential{{Username: "alice", Password: "secret"}},
+        DomainMappings:  []config.DomainMapping{{From: "upstream", To: upstreamURL}},
+        BruteForce:      config.BruteForceConfig{Disabled: true},
+    }
+}
+
+// startHTTPProxy serves cfg on a loopback port and returns its address
+func startHTTPProxy(t *testing.T, cfg *config.Config) string {
+    t.Helper()
+    return newProxyFixture(t, cfg).serveHTTP(t)
+}
+
+// handshake opens a session for alice and returns its token
+func handshake(t *testing.T, address string) string {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodPost, "http://"+address+"/handshake", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Username", "alice")
+    req.Header.Set("Password", "secret")
+    req.Header.Set("Domain-Name", "upstream")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    token := resp.Header.Get("Session-Token")
+    if resp.StatusCode != http.StatusOK || token == "" {
+        t.Fatalf("handshake = %d, token %q", resp.StatusCode, token)
+    }
+    return token
+}
+
+func TestRefusedRequestBodyIsNotParsedAsARequest(t *testing.T) {
+    upstream := startRecordingUpstream(t, nil)
+    cfg := newHTTPTestConfig(upstream.URL)
+    cfg.MaxBodySize = 1024
+    address := startHTTPProxy(t, cfg)
+    token := handshake(t, address)
+
+    // A complete proxy request hidden in the body, behind padding larger than
+    // what the server reads ahead together with the headers
+    smuggled := "GET / HTTP/1.1\r\nHost: proxy\r\nSession-Token: " + token + "\r\nSub-URL: /smuggled\r\n\r\n"
+    for _, test := range []struct {
+        name    string
+        headers string
+        padding int
+        status  int
+    }{
+        {"invalid session", "Session-Token: bogus\r\n", 16 * 1024, http.StatusUnauthorized},
+        {"body too large", "Session-Token: " + token + "\r\nSub-URL: /upload\r\n", 16 * 1024, http.StatusRequestEntityTooLarge},
+        {"body too large to discard", "Session-Token: " + token + "\r\nSub-URL: /upload\r\n", 256 * 1024, http.StatusRequestEntityTooLarge},
+    } {
+        t.Run(test.name, func(t *testing.T) {
+            conn, err := net.Dial("tcp", address)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+
+            body := strings.Repeat("x", test.padding) + smuggled
+            go fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: proxy\r\n%sContent-Length: %d\r\n\r\n%s", test.headers, len(body), body)
+
+            conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+            reader := bufio.NewReader(conn)
+            resp, err := http.ReadResponse(reader, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+            if resp.StatusCode != test.status {
+                t.Errorf("status = %d, want %d", resp.StatusCode, test.status)
+            }
+
+            // The connection must either close or stay quiet, a second response means the body was parsed
+            conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+            if second, err := http.ReadResponse(reader, nil); err == nil {
+                t.Errorf("unexpected second response %d", second.StatusCode)
+            }
+        })
+    }
+
+    for _, path := range upstream.paths() {
+        if path == "/smuggled" {
+            t.Error("the request hidden in a refused body was proxied upstream")
+        }
+    }
+}
+
+func TestStreamedResponseOutlivesIdleTimeout(t *testing.T) {
+    // An event stream that takes longer than the idle timeout in total, but
+    // never pauses for that long
+    upstream := startRecordingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/event-stream")
+        for i := 0; i < 6; i++ {
+            fmt.Fprintf(w, "data: %d\n\n", i)
+            w.(http.Flusher).Flush()
+            time.Sleep(100 * time.Millisecond)
+        }
+    })
+    cfg := newHTTPTestConfig(upstream.URL)
+    cfg.UpstreamIdleTimeout = config.Duration(300 * time.Millisecond)
+    address := startHTTPProxy(t, cfg)
+    token := handshake(t, address)
+
+    req, err := http.NewRequest(http.MethodGet, "http://"+address+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Session-Token", token)
+    req.Header.Set("Sub-URL", "/events")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatalf("reading the stream: %s", err)
+    }
+    if events := strings.Count(string(body), "data: "); events != 6 {
+        t.Errorf("received %d events, want 6", events)
+    }
+}
+
+func TestProxyHeadersAreNotForwarded(t *testing.T) {
+    upstream := startRecordingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Connection", "X-Upstream-Hop")
+        w.Header().Set("X-Upstream-Hop", "1")
+        w.Header().Set("Keep-Alive", "timeout=5")
+        w.Header().Set("Proxy-Authenticate", "Basic")
+        w.Header().Set("Content-Type", "text/plain")
+        w.Write([]byte("ok"))
+    })
+    address := startHTTPProxy(t, newHTTPTestConfig(upstream.URL))
+    token := handshake(t, address)
+
+    req, err := http.NewRequest(http.MethodGet, "http://"+address+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Session-Token", token)
+    req.Header.Set("Sub-URL", "/page")
+    req.Header.Set("Keep-Alive", "timeout=5")
+    req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+    req.Header.Set("Connection", "X-Hop")
+    req.Header.Set("X-Hop", "1")
+    req.Header.Set("Accept", "text/html")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    // Hop-by-hop headers of the upstream response stay between upstream and proxy
+    for _, name := range []string{"Connection", "X-Upstream-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+        if value := resp.Header.Get(name); value != "" {
+            t.Errorf("%s sent to the client: %q", name, value)
+        }
+    }
+    if resp.Header.Get("Content-Type") != "text/plain" || string(body) != "ok" {
+        t.Errorf("response = %q, %q, want the upstream's", resp.Header.Get("Content-Type"), body)
+    }
+
+    upstream.mutex.Lock()
+    defer upstream.mutex.Unlock()
+    if len(upstream.requests) != 1 {
+        t.Fatalf("upstream received %d requests, want 1", len(upstream.requests))
+    }
+    received := upstream.requests[0].Header
+    for _, name := range []string{"Session-Token", "Sub-URL", "Keep-Alive", "Proxy-Authorization", "X-Hop"} {
+        if value := received.Get(name); value != "" {
+            t.Errorf("%s forwarded upstream: %q", name, value)
+        }
+    }
+    if received.Get("Accept") != "text/html" {
+        t.Error("the Accept header of the client was not forwarded")
+    }
+}
+
+func TestHTTPProxyShutdownBeforeServe(t *testing.T) {
+    // Shutdown can come before ListenAndServe got to Serve, e.g. on an early SIGTERM
+    for i := 0; i < 20; i++ {
+        f := newProxyFixture(t, newHTTPTestConfig("http://127.0.0.1:1"))
+        f.cfg.Listeners.HTTP.Address = "127.0.0.1:0"
+        p := NewHTTPProxy(f.cfg, f.logger, f.store, f.guard, f.traffic, f.metrics)
+
+        served := make(chan error, 1)
+        if i == 0 {
+            p.Shutdown(context.Background())
+            go func() { served <- p.ListenAndServe() }()
+        } else {
+            go func() { served <- p.ListenAndServe() }()
+            p.Shutdown(context.Background())
+        }
+
+        select {
+        case err := <-served:
+            if err != nil {
+                t.Errorf("ListenAndServe after Shutdown = %v, want nil", err)
+            }
+        case <-time.After(2 * time.Second):
+            t.Fatal("the proxy kept serving after Shutdown")
+        }
+    }
+}
+
+func TestMalformedRequestCredentialsNotLogged(t *testing.T) {
+    f := newProxyFixture(t, newHTTPTestConfig("http://127.0.0.1:1"))
+    dir := t.TempDir()
+    if err := f.logger.InitializeLogging(dir); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(f.logger.Close)
+    f.logger.Configure(logging.Settings{Level: "warn"})
+    address := f.serveHTTP(t)
+
+    conn, err := net.Dial("tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    // fasthttp rejects the header name with a space and logs the request it read
+    fmt.Fprint(conn, "POST /handshake HTTP/1.1\r\nHost: proxy\r\nPassword: hunter2\r\nSession-Token: v1.key.payload.signature\r\nBad Name: x\r\n\r\n")
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    io.ReadAll(conn)
+
+    var data []byte
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if data, err = os.ReadFile(filepath.Join(dir, "server.log")); err == nil && strings.Contains(string(data), "error when reading request headers") {
+            break
+        }
+    }
+    if !strings.Contains(string(data), "error when reading request headers") {
+        t.Fatalf("server.log = %q, want the malformed request", data)
+    }
+    for _, secret := range []string{"hunter2", "v1.key.payload.signature"} {
+        if strings.Contains(string(data), secret) {
+            t.Errorf("server.log = %q, contains %q", data, secret)
+        }
+    }
+}
+
+// post sends a POST request with the given headers and returns the response, its body already closed
+func post(t *testing.T, address, path string, headers map[string]string) *http.Response {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodPost, "http://"+address+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp
+}
+
+func TestLogout(t *testing.T) {
+    f := newProxyFixture(t, newHTTPTestConfig("http://127.0.0.1:1"))
+    address := f.serveHTTP(t)
+    token := handshake(t, address)
+    other := handshake(t, address)
+
+    for _, test := range []struct {
+        name    string
+        headers map[string]string
+        want    int
+    }{
+        {"missing token", nil, http.StatusUnauthorized},
+        {"unknown token", map[string]string{"Session-Token": "unknown"}, http.StatusUnauthorized},
+        {"valid token", map[string]string{"Session-Token": token}, http.StatusOK},
+        {"token already logged out", map[string]string{"Session-Token": token}, http.StatusUnauthorized},
+    } {
+        if resp := post(t, address, "/logout", test.headers); resp.StatusCode != test.want {
+            t.Errorf("%s: logout = %d, want %d", test.name, resp.StatusCode, test.want)
+        }
+    }
+
+    // Only the client IP of the handshake may end the session
+    dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+    client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+    req, _ := http.NewRequest(http.MethodPost, "http://"+address+"/logout", nil)
+    req.Header.Set("Session-Token", other)
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("logout from another IP = %d, want 401", resp.StatusCode)
+    }
+    if _, exists := f.store.Lookup(token); exists {
+        t.Error("session still live after logout")
+    }
+    if _, exists := f.store.Lookup(other); !exists {
+        t.Error("logout ended another session of the user")
+    }
+}
+
+func TestAdminRevoke(t *testing.T) {
+    cfg := newHTTPTestConfig("http://127.0.0.1:1")
+    cfg.UserCredentials = append(cfg.UserCredentials, config.UserCredential{Username: "root", Password: "toor", Admin: true})
+    f := newProxyFixture(t, cfg)
+    address := f.serveHTTP(t)
+    first := handshake(t, address)
+    second := handshake(t, address)
+
+    admin := func(headers map[string]string) map[string]string {
+        headers["Username"] = "root"
+        headers["Password"] = "toor"
+        return headers
+    }
+    for _, test := range []struct {
+        name    string
+        headers map[string]string
+        want    int
+    }{
+        {"not an admin", map[string]string{"Username": "alice", "Password": "secret", "Revoke-User": "alice"}, http.StatusForbidden},
+        {"wrong password", map[string]string{"Username": "root", "Password": "wrong", "Revoke-User": "alice"}, http.StatusUnauthorized},
+        {"nothing to revoke", admin(map[string]string{}), http.StatusBadRequest},
+        {"unknown token", admin(map[string]string{"Revoke-Token": "unknown"}), http.StatusNotFound},
+        {"one token", admin(map[string]string{"Revoke-Token": first}), http.StatusOK},
+    } {
+        if resp := post(t, address, "/admin/revoke", test.headers); resp.StatusCode != test.want {
+            t.Errorf("%s: revoke = %d, want %d", test.name, resp.StatusCode, test.want)
+        }
+    }
+    if _, exists := f.store.Lookup(first); exists {
+        t.Error("revoked token still live")
+    }
+    if _, exists := f.store.Lookup(second); !exists {
+        t.Fatal("revoking one token ended another session")
+    }
+
+    if resp := post(t, address, "/admin/revoke", admin(map[string]string{"Revoke-User": "alice"})); resp.StatusCode != http.StatusOK {
+        t.Errorf("revoke of a user = %d, want 200", resp.StatusCode)
+    }
+    if _, exists := f.store.Lookup(second); exists {
+        t.Error("session still live after revoking its user")
+    }
+}
+
+func TestMetricsScrapedFromAdminListener(t *testing.T) {
+    upstream := startRecordingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    })
+    f := newProxyFixture(t, newHTTPTestConfig(upstream.URL))
+    address := f.serveHTTP(t)
+
+    // The admin server listens on its configured address, reserve a free port for it
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    adminAddress := listener.Addr().String()
+    listener.Close()
+    admin := metrics.NewAdminServer(adminAddress, f.metrics, f.logger)
+    go admin.ListenAndServe()
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        admin.Shutdown(ctx)
+    })
+
+    token := handshake(t, address)
+    req, err := http.NewRequest(http.MethodGet, "http://"+address+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Session-Token", token)
+    req.Header.Set("Sub-URL", "/page")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("proxied request = %d, want 200", resp.StatusCode)
+    }
+
+    want := []string{
+        `isp_bypass_handshakes_total{result="success"} 1`,
+        `isp_bypass_http_requests_total{mapping="upstream",status="200"} 1`,
+        `isp_bypass_upstream_duration_seconds_count{mapping="upstream"} 1`,
+    }
+    // The request is counted once its response is written, and the admin
+    // listener may still be starting, so scrape until the counters show up
+    var scraped string
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        resp, err := http.Get("http://" + adminAddress + "/metrics")
+        if err != nil {
+            continue
+        }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        scraped = string(body)
+        if containsLines(scraped, want) {
+            return
+        }
+    }
+    t.Errorf("/metrics = %q, want the lines %q", scraped, want)
+}
+
+// containsLines reports whether text contains every one of lines as a whole line
+func containsLines(text string, lines []string) bool {
+    present := make(map[string]bool)
+    for _, line := range strings.Split(text, "\n") {
+        present[line] = true
+    }
+    for _, line := range lines {
+        if !present[line] {
+            return false
+        }
+    }
+    return true
+}
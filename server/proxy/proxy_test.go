@@ -0,0 +1,92 @@
+package proxy
+
+import (
+    "context"
+    "net"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/traffic"
+)
+
+// proxyFixture holds the components both proxies are built from. They are
+// closed when the test ends.
+type proxyFixture struct {
+    cfg     *config.Config
+    logger  *logging.Logging
+    store   *session.MemoryStore
+    guard   *AuthGuard
+    traffic *TrafficControl
+    metrics *metrics.Metrics
+}
+
+// newProxyFixture creates the components of a proxy serving cfg, logging errors only
+func newProxyFixture(t *testing.T, cfg *config.Config) *proxyFixture {
+    t.Helper()
+    logger := logging.New(false)
+    logger.Configure(logging.Settings{Level: "error"})
+
+    store := session.NewMemoryStore(time.Minute)
+    t.Cleanup(store.Close)
+    guard := NewAuthGuard(cfg, logger)
+    t.Cleanup(guard.Close)
+    usage, err := traffic.NewUsageStore(filepath.Join(t.TempDir(), "usage.json"), logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(usage.Close)
+    trafficControl := NewTrafficControl(cfg, logger, usage)
+    t.Cleanup(trafficControl.Close)
+
+    return &proxyFixture{cfg: cfg, logger: logger, store: store, guard: guard, traffic: trafficControl, metrics: metrics.New()}
+}
+
+// serveHTTP serves the HTTP proxy on a loopback port and returns its address
+func (f *proxyFixture) serveHTTP(t *testing.T) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := NewHTTPProxy(f.cfg, f.logger, f.store, f.guard, f.traffic, f.metrics)
+    go p.server.Serve(listener)
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        p.Shutdown(ctx)
+    })
+    return listener.Addr().String()
+}
+
+// serveSOCKS5 serves the SOCKS5 proxy on a loopback port and returns its address
+func (f *proxyFixture) serveSOCKS5(t *testing.T) string {
+    t.Helper()
+    f.cfg.Listeners.SOCKS.Address = "127.0.0.1:0"
+    p, err := NewSOCKS5Proxy(f.cfg, f.logger, f.store, f.guard, f.traffic, f.metrics)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go p.ListenAndServe()
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        p.Shutdown(ctx)
+    })
+
+    // ListenAndServe picks the port, wait until it is listening
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        p.mutex.Lock()
+        listener := p.listener
+        p.mutex.Unlock()
+        if listener != nil {
+            return listener.Addr().String()
+        }
+    }
+    t.Fatal("SOCKS5 proxy did not start listening")
+    return ""
+}
@@ -1,86 +1,273 @@
 package proxy
 
 import (
-    "bufio"
+    "context"
     "errors"
+    "fmt"
     "io"
+    "log/slog"
+    "net"
+    "strings"
+    "sync"
+    "time"
 
     "github.com/armon/go-socks5"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
     "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/session"
 )
 
+// SOCKS5 protocol constants, RFC 1928 and RFC 1929
+const (
+    socks5Version   = uint8(0x05)
+    userPassVersion = uint8(0x01)
+    userPassSuccess = uint8(0x00)
+    userPassFailure = uint8(0x01)
+)
+
 // Custom errors for authentication
 var (
-    ErrAuthenticationFailed = errors.New("authentication failed")
+    ErrAuthenticationFailed   = errors.New("authentication failed")
+    ErrUnsupportedAuthVersion = errors.New("unsupported username/password auth version")
+    ErrLockedOut              = errors.New("locked out after too many failed authentications")
 )
 
-// StartSOCKS5Proxy starts a SOCKS5 proxy server to handle TCP and UDP traffic.
-func StartSOCKS5Proxy(cfg *config.Config, logging *logging.Logging, sessionStore *session.SessionStore) {
-    logging.Logln("Starting SOCKS5 proxy on :1080")
+// SOCKS5Proxy serves authenticated SOCKS5 clients and keeps track of their
+// connections so that it can be shut down gracefully.
+type SOCKS5Proxy struct {
+    server   *socks5.Server
+    traffic  *TrafficControl
+    listener net.Listener
+    conns    map[net.Conn]struct{}
+    closing  bool
+    mutex    sync.Mutex
+    wg       sync.WaitGroup
+    Config   *config.Config
+    Logging  *logging.Logging
+}
+
+// NewSOCKS5Proxy creates a SOCKS5 proxy server to handle TCP traffic.
+func NewSOCKS5Proxy(cfg *config.Config, logging *logging.Logging, sessionStore session.SessionStore, guard *AuthGuard, trafficControl *TrafficControl, m *metrics.Metrics) (*SOCKS5Proxy, error) {
+    logging = logging.Component("socks")
 
     // Custom authentication method
     credChecker := &UserPassAuthenticator{
         Config:       cfg,
         SessionStore: sessionStore,
-        Logging:       logging,
+        Guard:        guard,
+        Logging:      logging,
+        Metrics:      m,
     }
 
-    // Create a SOCKS5 server with custom authentication
+    // Create a SOCKS5 server with custom authentication, restricted to the mapped domains
     conf := &socks5.Config{
         AuthMethods: []socks5.Authenticator{credChecker},
+        Rules:       &DomainRuleSet{Config: cfg, Traffic: trafficControl, Logging: logging, Metrics: m},
+        Resolver:    &MappingResolver{Config: cfg},
+        Rewriter:    &MappingRewriter{Config: cfg},
+        Dial:        (&AccessDialer{Logging: logging, Metrics: m}).Dial,
+        Logger:      logging.FilteredStdLogger(slog.LevelWarn, socksLogFilter),
     }
     server, err := socks5.New(conf)
     if err != nil {
-        logging.Fatalf("Failed to create SOCKS5 server: %v", err)
+        return nil, fmt.Errorf("failed to create SOCKS5 server: %w", err)
+    }
+
+    return &SOCKS5Proxy{
+        server:  server,
+        traffic: trafficControl,
+        conns:   make(map[net.Conn]struct{}),
+        Config:  cfg,
+        Logging: logging,
+    }, nil
+}
+
+// ListenAndServe listens on the configured address and blocks until Shutdown is called.
+func (p *SOCKS5Proxy) ListenAndServe() error {
+    address := p.Config.GetListeners().SOCKS.Address
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return fmt.Errorf("failed to listen on %s: %w", address, err)
     }
 
-    // Start listening on port 1080
-    if err := server.ListenAndServe("tcp", ":1080"); err != nil {
-        logging.Fatalf("Failed to start SOCKS5 server: %v", err)
+    p.mutex.Lock()
+    if p.closing {
+        p.mutex.Unlock()
+        listener.Close()
+        return nil
+    }
+    p.listener = listener
+    p.mutex.Unlock()
+    p.Logging.Info("Starting SOCKS5 proxy", "address", address)
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            p.mutex.Lock()
+            closing := p.closing
+            p.mutex.Unlock()
+            if closing {
+                return nil
+            }
+            return err
+        }
+
+        p.track(conn)
+        go func() {
+            defer p.untrack(conn)
+            p.server.ServeConn(&meteredConn{halfCloseConn: halfCloseConn{conn}, control: p.traffic})
+        }()
     }
 }
 
+// Shutdown stops accepting connections and waits for open connections until ctx expires,
+// remaining connections are closed after that.
+func (p *SOCKS5Proxy) Shutdown(ctx context.Context) error {
+    p.mutex.Lock()
+    p.closing = true
+    if p.listener != nil {
+        p.listener.Close()
+    }
+    p.mutex.Unlock()
+
+    drained := make(chan struct{})
+    go func() {
+        p.wg.Wait()
+        close(drained)
+    }()
+
+    select {
+    case <-drained:
+        return nil
+    case <-ctx.Done():
+        p.mutex.Lock()
+        p.Logging.Warn("Closing SOCKS5 connections still open after the shutdown deadline", "connections", len(p.conns))
+        for conn := range p.conns {
+            conn.Close()
+        }
+        p.mutex.Unlock()
+        <-drained
+        return ctx.Err()
+    }
+}
+
+func (p *SOCKS5Proxy) track(conn net.Conn) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.conns[conn] = struct{}{}
+    p.wg.Add(1)
+}
+
+func (p *SOCKS5Proxy) untrack(conn net.Conn) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    delete(p.conns, conn)
+    p.wg.Done()
+}
+
 // UserPassAuthenticator implements the SOCKS5 authentication interface.
 type UserPassAuthenticator struct {
     Config       *config.Config
-    SessionStore *session.SessionStore
+    SessionStore session.SessionStore
+    Guard        *AuthGuard
     Logging       *logging.Logging
+    Metrics      *metrics.Metrics
 }
 
 // GetCode returns the SOCKS5 authentication code for User/Password.
 func (a *UserPassAuthenticator) GetCode() uint8 {
-    // Typically, 0x02 represents Username/Password authentication in SOCKS5.
-    return 0x02
+    return socks5.UserPassAuth
 }
 
-// Authenticate verifies the username and password sent from the client.
+// Authenticate runs the RFC 1929 username/password sub-negotiation
+// and verifies the credentials sent by the client.
 func (a *UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
-    bufReader := bufio.NewReader(reader)
+    // Tell the client to use username/password authentication
+    if _, err := writer.Write([]byte{socks5Version, socks5.UserPassAuth}); err != nil {
+        return nil, err
+    }
 
-    // Read username and password length and values (customize as needed)
-    username, err := bufReader.ReadString('\n')
-    if err != nil {
-        return nil, ErrAuthenticationFailed
+    // Read the sub-negotiation version and username length
+    header := []byte{0, 0}
+    if _, err := io.ReadFull(reader, header); err != nil {
+        return nil, err
+    }
+    if header[0] != userPassVersion {
+        writer.Write([]byte{userPassVersion, userPassFailure})
+        return nil, ErrUnsupportedAuthVersion
     }
-    username = username[:len(username)-1] // Strip newline
 
-    password, err := bufReader.ReadString('\n')
-    if err != nil {
-        return nil, ErrAuthenticationFailed
+    // Read the username
+    username := make([]byte, int(header[1]))
+    if _, err := io.ReadFull(reader, username); err != nil {
+        return nil, err
     }
-    password = password[:len(password)-1] // Strip newline
 
-    a.Logging.Logf("Attempting to authenticate user: %s", username)
+    // Read the password length and the password
+    if _, err := io.ReadFull(reader, header[:1]); err != nil {
+        return nil, err
+    }
+    password := make([]byte, int(header[0]))
+    if _, err := io.ReadFull(reader, password); err != nil {
+        return nil, err
+    }
+
+    // Locked out clients are disconnected without checking the password.
+    // The writer is the client connection, it tells us the client IP.
+    clientIP := ""
+    if conn, ok := writer.(net.Conn); ok {
+        clientIP, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+    }
+    logger := a.Logging.With("user", string(username), "client_ip", clientIP)
+    logger.Debug("Attempting to authenticate user")
+    if wait, locked := a.Guard.Check(clientIP, string(username)); locked {
+        logger.Warn("Refused locked out client", "retry_after", wait.Round(time.Second))
+        a.Metrics.AuthFailures.WithLabelValues("socks", "locked_out").Inc()
+        return nil, ErrLockedOut
+    }
 
     // Validate the username and password against the stored credentials.
-    if a.Config.AuthenticateUser(username, password) {
-        a.Logging.Logf("User '%s' authenticated successfully", username)
-        // Create an AuthContext with a string map for Payload.
-        return &socks5.AuthContext{Payload: map[string]string{"username": username}}, nil
+    if !a.Config.AuthenticateUser(string(username), string(password)) {
+        a.Guard.Failure(clientIP, string(username))
+        logger.Warn("Authentication failed")
+        a.Metrics.AuthFailures.WithLabelValues("socks", "invalid_credentials").Inc()
+        writer.Write([]byte{userPassVersion, userPassFailure})
+        return nil, ErrAuthenticationFailed
     }
+    a.Guard.Success(clientIP, string(username))
 
-    a.Logging.Logf("Authentication failed for user: %s", username)
-    return nil, ErrAuthenticationFailed
-}
\ No newline at end of file
+    if _, err := writer.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+        return nil, err
+    }
+
+    // Count the rest of the connection towards the user's traffic limits
+    if conn, ok := writer.(*meteredConn); ok {
+        conn.username = string(username)
+    }
+    logger.Debug("User authenticated")
+    return &socks5.AuthContext{
+        Method:  socks5.UserPassAuth,
+        Payload: map[string]string{"username": string(username)},
+    }, nil
+}
+
+// socksLogFilter drops the SOCKS5 server's messages about refused requests. They
+// name the requested host regardless of the user's privacy settings, and
+// DomainRuleSet already logged the refusal.
+func socksLogFilter(message string) (string, bool) {
+    return message, !strings.HasSuffix(message, " blocked by rules")
+}
+
+// halfCloseConn is embedded by the connection wrappers of the SOCKS5 proxy. It
+// forwards half-closes, the SOCKS5 server uses them to end one direction.
+type halfCloseConn struct {
+    net.Conn
+}
+
+func (c halfCloseConn) CloseWrite() error {
+    if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+        return conn.CloseWrite()
+    }
+    return nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "golang.org/x/net/proxy"
+)
+
+// startEchoServer starts a TCP server on loopback that sends back everything it receives
+func startEchoServer(t *testing.T) net.Listener {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return listener
+}
+
+// startSOCKS5Proxy serves cfg on a loopback port and returns its address
+func startSOCKS5Proxy(t *testing.T, cfg *config.Config) string {
+    t.Helper()
+    cfg.BruteForce.Disabled = true
+    return newProxyFixture(t, cfg).serveSOCKS5(t)
+}
+
+// newSOCKSTestConfig allows alice to reach the echo server through a mapping
+func newSOCKSTestConfig(echo net.Listener) *config.Config {
+    return &config.Config{
+        UserCredentials: []config.UserCredential{{Username: "alice", Password: "secret"}},
+        DomainMappings:  []config.DomainMapping{{From: "echo", To: "http://" + echo.Addr().String()}},
+    }
+}
+
+func TestSOCKS5ConnectWithPassword(t *testing.T) {
+    echo := startEchoServer(t)
+    address := startSOCKS5Proxy(t, newSOCKSTestConfig(echo))
+
+    dialer, err := proxy.SOCKS5("tcp", address, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, err := dialer.Dial("tcp", echo.Addr().String())
+    if err != nil {
+        t.Fatalf("Dial through the proxy: %s", err)
+    }
+    defer conn.Close()
+
+    if _, err := conn.Write([]byte("ping")); err != nil {
+        t.Fatal(err)
+    }
+    reply := make([]byte, 4)
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+        t.Errorf("echo = %q, %v, want \"ping\"", reply, err)
+    }
+}
+
+func TestSOCKS5WrongPassword(t *testing.T) {
+    echo := startEchoServer(t)
+    address := startSOCKS5Proxy(t, newSOCKSTestConfig(echo))
+
+    dialer, err := proxy.SOCKS5("tcp", address, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conn, err := dialer.Dial("tcp", echo.Addr().String()); err == nil {
+        conn.Close()
+        t.Fatal("Dial with a wrong password succeeded")
+    }
+
+    // RFC 1929: the server answers with VER 0x01 and a non-zero STATUS, then closes
+    reply := userPassExchange(t, address, []byte{userPassVersion, 5, 'a', 'l', 'i', 'c', 'e', 5, 'w', 'r', 'o', 'n', 'g'})
+    if !bytes.Equal(reply, []byte{userPassVersion, userPassFailure}) {
+        t.Errorf("reply = %v, want %v", reply, []byte{userPassVersion, userPassFailure})
+    }
+}
+
+func TestSOCKS5WrongAuthVersion(t *testing.T) {
+    echo := startEchoServer(t)
+    address := startSOCKS5Proxy(t, newSOCKSTestConfig(echo))
+
+    // Correct credentials, but sent with sub-negotiation version 0x02
+    reply := userPassExchange(t, address, []byte{0x02, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+    if !bytes.Equal(reply, []byte{userPassVersion, userPassFailure}) {
+        t.Errorf("reply = %v, want %v", reply, []byte{userPassVersion, userPassFailure})
+    }
+}
+
+func TestSOCKS5RefusesUnmappedDestinations(t *testing.T) {
+    echo := startEchoServer(t)
+    other := startEchoServer(t)
+    address := startSOCKS5Proxy(t, newSOCKSTestConfig(echo))
+
+    dialer, err := proxy.SOCKS5("tcp", address, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Another port of the mapped host, a name that must not even be resolved,
+    // and the mapping name while name rewriting is off
+    _, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+    for _, target := range []string{other.Addr().String(), "unmapped.invalid:80", "echo:" + echoPort} {
+        conn, err := dialer.Dial("tcp", target)
+        if err == nil {
+            conn.Close()
+            t.Errorf("Dial(%s) succeeded", target)
+            continue
+        }
+        if !strings.Contains(err.Error(), "not allowed by ruleset") {
+            t.Errorf("Dial(%s) = %s, want a ruleset refusal", target, err)
+        }
+    }
+}
+
+// userPassExchange offers username/password authentication, sends the raw
+// sub-negotiation request and returns the server's reply. It fails the test
+// if the server keeps the connection open afterwards.
+func userPassExchange(t *testing.T, address string, request []byte) []byte {
+    t.Helper()
+    conn, err := net.Dial("tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+    if _, err := conn.Write([]byte{socks5Version, 1, 0x02}); err != nil {
+        t.Fatal(err)
+    }
+    method := make([]byte, 2)
+    if _, err := io.ReadFull(conn, method); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(method, []byte{socks5Version, 0x02}) {
+        t.Fatalf("method selection = %v, want username/password", method)
+    }
+
+    if _, err := conn.Write(request); err != nil {
+        t.Fatal(err)
+    }
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        t.Fatal(err)
+    }
+    if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+        t.Error("connection stayed open after the failed authentication")
+    }
+    return reply
+}
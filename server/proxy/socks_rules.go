@@ -0,0 +1,144 @@
+package proxy
+
+import (
+    "context"
+    "net"
+    "time"
+
+    "github.com/armon/go-socks5"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+    "github.com/valyala/fasthttp"
+)
+
+// DomainRuleSet implements the SOCKS5 rule set interface. Only CONNECT requests
+// to hosts named in the domain mappings are permitted, on the port of the
+// mapping's target URL and subject to the user's domain policy.
+type DomainRuleSet struct {
+    Config  *config.Config
+    Traffic *TrafficControl
+    Logging *logging.Logging
+    Metrics *metrics.Metrics
+}
+
+// Allow checks whether the authenticated user may reach the requested destination.
+func (r *DomainRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+    username := socksUsername(req)
+    host := destinationHost(req.DestAddr)
+    clientIP := ""
+    if req.RemoteAddr != nil {
+        clientIP = req.RemoteAddr.IP.String()
+    }
+    logger := r.Logging.With("user", username, "client_ip", clientIP)
+
+    if req.Command != socks5.ConnectCommand {
+        logger.Warn("Unsupported SOCKS5 command", "command", req.Command)
+        return ctx, false
+    }
+
+    // Refused connections are written to the access log right away, allowed
+    // ones by AccessDialer once they are closed
+    access := newSOCKSAccess(r.Config, req, username)
+    // The requested host is logged as far as the user's privacy settings allow
+    if target, recorded := access.privacy.Address(host); recorded {
+        logger = logger.With("target", target)
+    }
+    mapping, exists := r.Config.GetMappingForHost(host)
+    if !exists {
+        logger.Warn("Connection to an unmapped host refused")
+        r.refuse(access, fasthttp.StatusForbidden, "refused")
+        return ctx, false
+    }
+    access.entry.Mapping = mapping.From
+
+    // The mapping only covers the service its URL names, not other ports of the same host
+    if req.DestAddr.Port != mapping.Port() {
+        logger.Warn("Connection to an unmapped port refused", "domain", mapping.From, "port", req.DestAddr.Port)
+        r.refuse(access, fasthttp.StatusForbidden, "refused")
+        return ctx, false
+    }
+
+    if !r.Config.AuthorizeDomain(username, mapping.From) {
+        logger.Warn("User is not allowed to access the domain", "domain", mapping.From)
+        r.refuse(access, fasthttp.StatusForbidden, "refused")
+        return ctx, false
+    }
+
+    if _, err := r.Traffic.Admit(username, ""); err != nil {
+        logger.Warn("Connection refused by traffic limits", "error", err)
+        r.refuse(access, fasthttp.StatusTooManyRequests, "rate_limited")
+        return ctx, false
+    }
+    logger.Info("Connection allowed", "domain", mapping.From)
+    return withSOCKSAccess(ctx, access), true
+}
+
+// refuse writes the access log entry of a refused CONNECT and counts it under result
+func (r *DomainRuleSet) refuse(access socksAccess, status int, result string) {
+    access.entry.Status = status
+    access.entry.Duration = time.Since(access.entry.Time)
+    r.Logging.Access(access.entry, access.privacy)
+    r.Metrics.SOCKSConnections.WithLabelValues(result).Inc()
+}
+
+// MappingResolver resolves the hosts of the domain mappings, and mapping names
+// to the address of their target host when name rewriting is enabled.
+type MappingResolver struct {
+    Config *config.Config
+}
+
+// Resolve implements the SOCKS5 name resolver interface. The SOCKS5 server
+// resolves before the rule set runs, so names outside the mappings are not
+// looked up at all. They resolve to no address and DomainRuleSet refuses
+// them with "not allowed by ruleset".
+func (r *MappingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+    if _, exists := r.Config.GetMappingForHost(name); !exists {
+        return ctx, nil, nil
+    }
+    if r.Config.RewriteSOCKSNames() {
+        if mapping, exists := r.Config.GetMapping(name); exists {
+            name = mapping.Host()
+        }
+    }
+    return socks5.DNSResolver{}.Resolve(ctx, name)
+}
+
+// MappingRewriter rewrites a destination given as a mapping name, e.g. "github",
+// to the real host of the mapping. The address was already resolved by MappingResolver.
+type MappingRewriter struct {
+    Config *config.Config
+}
+
+// Rewrite implements the SOCKS5 address rewriter interface.
+func (r *MappingRewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *socks5.AddrSpec) {
+    if !r.Config.RewriteSOCKSNames() || req.DestAddr.FQDN == "" {
+        return ctx, req.DestAddr
+    }
+
+    mapping, exists := r.Config.GetMapping(req.DestAddr.FQDN)
+    if !exists {
+        return ctx, req.DestAddr
+    }
+    return ctx, &socks5.AddrSpec{
+        FQDN: mapping.Host(),
+        IP:   req.DestAddr.IP,
+        Port: req.DestAddr.Port,
+    }
+}
+
+// socksUsername returns the user name stored in the request's auth context
+func socksUsername(req *socks5.Request) string {
+    if req.AuthContext == nil {
+        return ""
+    }
+    return req.AuthContext.Payload["username"]
+}
+
+// destinationHost returns the host name of a destination, or its IP if no name was sent
+func destinationHost(addr *socks5.AddrSpec) string {
+    if addr.FQDN != "" {
+        return addr.FQDN
+    }
+    return addr.IP.String()
+}
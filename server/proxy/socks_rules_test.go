@@ -0,0 +1,109 @@
+package proxy
+
+import (
+    "context"
+    "log/slog"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/armon/go-socks5"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/metrics"
+)
+
+func TestMappingResolverSkipsUnmappedNames(t *testing.T) {
+    cfg := &config.Config{
+        DomainMappings: []config.DomainMapping{{From: "local", To: "http://localhost:8000"}},
+    }
+    resolver := &MappingResolver{Config: cfg}
+
+    // An unmapped name must not reach DNS, it resolves to no address and is refused by the rule set
+    _, ip, err := resolver.Resolve(context.Background(), "unmapped.invalid")
+    if err != nil || ip != nil {
+        t.Errorf("Resolve(unmapped) = %v, %v, want no address and no error", ip, err)
+    }
+
+    _, ip, err = resolver.Resolve(context.Background(), "localhost")
+    if err != nil || !ip.IsLoopback() {
+        t.Errorf("Resolve(localhost) = %v, %v, want a loopback address", ip, err)
+    }
+}
+
+func TestMappingPort(t *testing.T) {
+    for to, want := range map[string]int{
+        "https://github.com":       443,
+        "http://example.com":       80,
+        "https://example.com:8443": 8443,
+        "http://[::1]:8080/path":   8080,
+    } {
+        if got := (config.DomainMapping{To: to}).Port(); got != want {
+            t.Errorf("Port(%s) = %d, want %d", to, got, want)
+        }
+    }
+}
+
+func TestMappingNamesNeedRewriting(t *testing.T) {
+    cfg := &config.Config{
+        DomainMappings: []config.DomainMapping{{From: "local", To: "http://localhost:8000"}},
+    }
+    resolver := &MappingResolver{Config: cfg}
+
+    // Without rewriting the bare name would go to the system resolver and its search domains
+    if _, ip, err := resolver.Resolve(context.Background(), "local"); err != nil || ip != nil {
+        t.Errorf("Resolve(local) without rewriting = %v, %v, want no address and no error", ip, err)
+    }
+    if _, exists := cfg.GetMappingForHost("local"); exists {
+        t.Error("mapping name matched without rewriting")
+    }
+
+    cfg.SOCKS.RewriteNames = true
+    if _, ip, err := resolver.Resolve(context.Background(), "local"); err != nil || !ip.IsLoopback() {
+        t.Errorf("Resolve(local) with rewriting = %v, %v, want the address of localhost", ip, err)
+    }
+}
+
+func TestRefusedHostFollowsPrivacy(t *testing.T) {
+    dir := t.TempDir()
+    logger := logging.New(false)
+    if err := logger.InitializeLogging(dir); err != nil {
+        t.Fatal(err)
+    }
+    defer logger.Close()
+    cfg := &config.Config{
+        UserCredentials: []config.UserCredential{
+            {Username: "alice", Password: "secret", VisitedLog: logging.VisitedNone},
+            {Username: "bob", Password: "secret", VisitedLog: logging.VisitedHashed},
+        },
+        DomainMappings: []config.DomainMapping{{From: "local", To: "http://localhost:8000"}},
+    }
+    rules := &DomainRuleSet{Config: cfg, Logging: logger, Metrics: metrics.New()}
+
+    for _, username := range []string{"alice", "bob"} {
+        req := &socks5.Request{
+            Command:     socks5.ConnectCommand,
+            DestAddr:    &socks5.AddrSpec{FQDN: "private.example", Port: 443},
+            RemoteAddr:  &socks5.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 50000},
+            AuthContext: &socks5.AuthContext{Payload: map[string]string{"username": username}},
+        }
+        if _, allowed := rules.Allow(context.Background(), req); allowed {
+            t.Fatalf("connection of %s to an unmapped host allowed", username)
+        }
+    }
+    // The SOCKS5 server reports the same refusal with the raw destination
+    logger.FilteredStdLogger(slog.LevelWarn, socksLogFilter).Printf("[ERR] socks: Failed to handle request: Connect to %v blocked by rules", "private.example:443")
+
+    data, err := os.ReadFile(filepath.Join(dir, "server.log"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(data), "Connection to an unmapped host refused") {
+        t.Fatalf("server.log = %q, want the refusals", data)
+    }
+    if strings.Contains(string(data), "private.example") {
+        t.Errorf("server.log = %q, names the refused host", data)
+    }
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+    "crypto/tls"
+    "path/filepath"
+    "sync"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/fsnotify/fsnotify"
+)
+
+// CertReloader serves a listener certificate and reloads it
+// whenever the certificate or key file changes on disk.
+type CertReloader struct {
+    certFile string
+    keyFile  string
+    cert     *tls.Certificate
+    mutex    sync.RWMutex
+    Logging  *logging.Logging
+}
+
+// NewCertReloader loads the key pair once and returns the reloader.
+func NewCertReloader(settings config.ListenerTLS, logging *logging.Logging) (*CertReloader, error) {
+    r := &CertReloader{
+        certFile: settings.CertFile,
+        keyFile:  settings.KeyFile,
+        Logging:  logging.With("certificate", settings.CertFile),
+    }
+    if err := r.reload(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+// reload reads the key pair from disk, the previous certificate stays active on failure.
+func (r *CertReloader) reload() error {
+    cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+    if err != nil {
+        return err
+    }
+    r.mutex.Lock()
+    r.cert = &cert
+    r.mutex.Unlock()
+    return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.cert, nil
+}
+
+// TLSConfig returns a server TLS configuration backed by the reloader.
+func (r *CertReloader) TLSConfig() *tls.Config {
+    return &tls.Config{
+        GetCertificate: r.GetCertificate,
+        MinVersion:     tls.VersionTLS12,
+    }
+}
+
+// Watch reloads the key pair when either file is written or replaced, until done is closed.
+func (r *CertReloader) Watch(done <-chan struct{}) {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        r.Logging.Error("Failed to create certificate watcher", "error", err)
+        return
+    }
+    defer watcher.Close()
+
+    // Watch the directories so that files replaced via rename are noticed too
+    certFile, _ := filepath.Abs(r.certFile)
+    keyFile, _ := filepath.Abs(r.keyFile)
+    for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+        if err := watcher.Add(dir); err != nil {
+            r.Logging.Error("Failed to watch certificate directory", "directory", dir, "error", err)
+            return
+        }
+    }
+
+    for {
+        select {
+        case <-done:
+            return
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return
+            }
+            name, _ := filepath.Abs(event.Name)
+            if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 || (name != certFile && name != keyFile) {
+                continue
+            }
+            if err := r.reload(); err != nil {
+                r.Logging.Error("Failed to reload TLS certificate, keeping the previous one", "error", err)
+                continue
+            }
+            r.Logging.Info("TLS certificate reloaded")
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return
+            }
+            r.Logging.Error("Certificate watcher error", "error", err)
+        }
+    }
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+    "errors"
+    "io"
+    "sync"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/traffic"
+)
+
+var (
+    ErrRateLimited   = errors.New("request rate limit exceeded")
+    ErrQuotaExceeded = errors.New("traffic quota exceeded")
+)
+
+// Idle rate limit buckets are dropped after bucketTTL, a new bucket starts full
+const (
+    trafficSweepInterval = time.Minute
+    bucketTTL            = 10 * time.Minute
+)
+
+// userBuckets holds the request rate and byte rate buckets of a user
+type userBuckets struct {
+    requests *traffic.Bucket
+    bytes    *traffic.Bucket
+}
+
+// TrafficControl enforces the traffic limits of the users: request rates per
+// user and per session, byte rate shaping per user and daily/monthly quotas.
+// It is shared by both proxies so that all of a user's traffic counts together.
+type TrafficControl struct {
+    users    map[string]*userBuckets
+    sessions map[string]*traffic.Bucket
+    mutex    sync.Mutex
+    done     chan struct{}
+    Usage    *traffic.UsageStore
+    Config   *config.Config
+    Logging  *logging.Logging
+}
+
+// NewTrafficControl creates a TrafficControl and starts dropping idle buckets in the background.
+func NewTrafficControl(cfg *config.Config, logging *logging.Logging, usage *traffic.UsageStore) *TrafficControl {
+    control := &TrafficControl{
+        users:    make(map[string]*userBuckets),
+        sessions: make(map[string]*traffic.Bucket),
+        done:     make(chan struct{}),
+        Usage:    usage,
+        Config:   cfg,
+        Logging:  logging.Component("traffic"),
+    }
+    go control.sweep()
+    return control
+}
+
+// Admit decides whether a user may send another request, sessionToken may be
+// empty for SOCKS5 connections. Refused requests return ErrQuotaExceeded or
+// ErrRateLimited and how long to wait before trying again.
+func (t *TrafficControl) Admit(username, sessionToken string) (time.Duration, error) {
+    limits := t.Config.GetTrafficLimits(username)
+
+    now := time.Now()
+    usage := t.Usage.Get(username)
+    if limits.DailyBytes > 0 && usage.DayBytes >= limits.DailyBytes {
+        return traffic.NextDay(now).Sub(now), ErrQuotaExceeded
+    }
+    if limits.MonthlyBytes > 0 && usage.MonthBytes >= limits.MonthlyBytes {
+        return traffic.NextMonth(now).Sub(now), ErrQuotaExceeded
+    }
+
+    if wait, ok := t.userBuckets(username, limits).requests.Allow(); !ok {
+        return wait, ErrRateLimited
+    }
+    if sessionToken != "" && limits.SessionRequestsPerSecond > 0 {
+        if wait, ok := t.sessionBucket(sessionToken, limits).Allow(); !ok {
+            return wait, ErrRateLimited
+        }
+    }
+    return 0, nil
+}
+
+// Transfer counts bytes sent or received for a user and blocks as long as needed
+// to keep the user's byte rate. It returns ErrQuotaExceeded once a quota is used up.
+func (t *TrafficControl) Transfer(username string, n int) error {
+    if n <= 0 {
+        return nil
+    }
+    limits := t.Config.GetTrafficLimits(username)
+    usage := t.Usage.Add(username, int64(n))
+    time.Sleep(t.userBuckets(username, limits).bytes.Take(n))
+
+    // Log only the transfer that crossed the quota, not every one after it
+    var exceeded error
+    if limits.DailyBytes > 0 && usage.DayBytes >= limits.DailyBytes {
+        if usage.DayBytes-int64(n) < limits.DailyBytes {
+            t.Logging.Warn("Daily traffic quota used up", "user", username, "quota", limits.DailyBytes)
+        }
+        exceeded = ErrQuotaExceeded
+    }
+    if limits.MonthlyBytes > 0 && usage.MonthBytes >= limits.MonthlyBytes {
+        if usage.MonthBytes-int64(n) < limits.MonthlyBytes {
+            t.Logging.Warn("Monthly traffic quota used up", "user", username, "quota", limits.MonthlyBytes)
+        }
+        exceeded = ErrQuotaExceeded
+    }
+    return exceeded
+}
+
+// Reader wraps a body so that reading it is counted and shaped for the user.
+func (t *TrafficControl) Reader(username string, reader io.Reader) io.Reader {
+    return &meteredReader{reader: reader, control: t, username: username}
+}
+
+// Close stops the background sweep.
+func (t *TrafficControl) Close() {
+    close(t.done)
+}
+
+// userBuckets returns the buckets of a user updated to the current limits
+func (t *TrafficControl) userBuckets(username string, limits config.TrafficLimits) *userBuckets {
+    t.mutex.Lock()
+    buckets, exists := t.users[username]
+    if !exists {
+        buckets = &userBuckets{
+            requests: traffic.NewBucket(limits.RequestsPerSecond, limits.Burst),
+            bytes:    traffic.NewBucket(float64(limits.BytesPerSecond), int(limits.BytesPerSecond)),
+        }
+        t.users[username] = buckets
+    }
+    t.mutex.Unlock()
+
+    if exists {
+        buckets.requests.SetLimit(limits.RequestsPerSecond, limits.Burst)
+        buckets.bytes.SetLimit(float64(limits.BytesPerSecond), int(limits.BytesPerSecond))
+    }
+    return buckets
+}
+
+// sessionBucket returns the request bucket of a session updated to the current limits
+func (t *TrafficControl) sessionBucket(sessionToken string, limits config.TrafficLimits) *traffic.Bucket {
+    t.mutex.Lock()
+    bucket, exists := t.sessions[sessionToken]
+    if !exists {
+        bucket = traffic.NewBucket(limits.SessionRequestsPerSecond, limits.Burst)
+        t.sessions[sessionToken] = bucket
+    }
+    t.mutex.Unlock()
+
+    if exists {
+        bucket.SetLimit(limits.SessionRequestsPerSecond, limits.Burst)
+    }
+    return bucket
+}
+
+// sweep drops buckets that were not used for bucketTTL
+func (t *TrafficControl) sweep() {
+    ticker := time.NewTicker(trafficSweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-t.done:
+            return
+        case <-ticker.C:
+        }
+
+        t.mutex.Lock()
+        now := time.Now()
+        for username, buckets := range t.users {
+            if now.Sub(buckets.requests.LastUsed()) > bucketTTL && now.Sub(buckets.bytes.LastUsed()) > bucketTTL {
+                delete(t.users, username)
+            }
+        }
+        for token, bucket := range t.sessions {
+            if now.Sub(bucket.LastUsed()) > bucketTTL {
+                delete(t.sessions, token)
+            }
+        }
+        t.mutex.Unlock()
+    }
+}
+
+// meteredReader counts and shapes the bytes read from a body
+type meteredReader struct {
+    reader   io.Reader
+    control  *TrafficControl
+    username string
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+    n, err := r.reader.Read(p)
+    if n > 0 {
+        if quotaErr := r.control.Transfer(r.username, n); quotaErr != nil {
+            return n, quotaErr
+        }
+    }
+    return n, err
+}
+
+// meteredConn counts and shapes the traffic of a SOCKS5 client connection once
+// the client authenticated, UserPassAuthenticator sets the username.
+type meteredConn struct {
+    halfCloseConn
+    control  *TrafficControl
+    username string
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    if n > 0 && c.username != "" {
+        if quotaErr := c.control.Transfer(c.username, n); quotaErr != nil {
+            return n, quotaErr
+        }
+    }
+    return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    if n > 0 && c.username != "" && err == nil {
+        err = c.control.Transfer(c.username, n)
+    }
+    return n, err
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/traffic"
+)
+
+// newTrafficTestControl applies limits to alice
+func newTrafficTestControl(t *testing.T, limits config.TrafficLimits) *TrafficControl {
+    t.Helper()
+    cfg := &config.Config{UserCredentials: []config.UserCredential{{Username: "alice", Password: "secret", Traffic: limits}}}
+    return newProxyFixture(t, cfg).traffic
+}
+
+func TestAdmitRequestRate(t *testing.T) {
+    control := newTrafficTestControl(t, config.TrafficLimits{RequestsPerSecond: 1, Burst: 2})
+    for i := 0; i < 2; i++ {
+        if _, err := control.Admit("alice", "token-1"); err != nil {
+            t.Fatalf("request %d of the burst: %v", i+1, err)
+        }
+    }
+    // The limit covers all sessions of the user and SOCKS5 connections
+    wait, err := control.Admit("alice", "")
+    if !errors.Is(err, ErrRateLimited) || wait <= 0 || wait > time.Second {
+        t.Errorf("Admit over the rate = %s, %v, want ErrRateLimited and a wait of up to a second", wait, err)
+    }
+    if _, err := control.Admit("bob", ""); err != nil {
+        t.Errorf("another user was limited: %v", err)
+    }
+}
+
+func TestAdmitSessionRate(t *testing.T) {
+    control := newTrafficTestControl(t, config.TrafficLimits{SessionRequestsPerSecond: 1, Burst: 1})
+    if _, err := control.Admit("alice", "token-1"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := control.Admit("alice", "token-1"); !errors.Is(err, ErrRateLimited) {
+        t.Errorf("second request of the session = %v, want ErrRateLimited", err)
+    }
+    if _, err := control.Admit("alice", "token-2"); err != nil {
+        t.Errorf("another session of the user was limited: %v", err)
+    }
+}
+
+func TestDailyQuota(t *testing.T) {
+    control := newTrafficTestControl(t, config.TrafficLimits{DailyBytes: 100})
+    if err := control.Transfer("alice", 60); err != nil {
+        t.Fatal(err)
+    }
+    if err := control.Transfer("alice", 50); !errors.Is(err, ErrQuotaExceeded) {
+        t.Errorf("Transfer over the quota = %v, want ErrQuotaExceeded", err)
+    }
+
+    // Further requests wait for the next UTC day
+    now := time.Now()
+    wait, err := control.Admit("alice", "")
+    if until := traffic.NextDay(now).Sub(now); !errors.Is(err, ErrQuotaExceeded) || wait > until || wait < until-time.Second {
+        t.Errorf("Admit = %s, %v, want ErrQuotaExceeded until the next day (%s)", wait, err, until)
+    }
+}
+
+func TestMonthlyQuota(t *testing.T) {
+    control := newTrafficTestControl(t, config.TrafficLimits{MonthlyBytes: 100})
+    if err := control.Transfer("alice", 100); !errors.Is(err, ErrQuotaExceeded) {
+        t.Errorf("Transfer of the whole quota = %v, want ErrQuotaExceeded", err)
+    }
+    now := time.Now()
+    wait, err := control.Admit("alice", "")
+    if until := traffic.NextMonth(now).Sub(now); !errors.Is(err, ErrQuotaExceeded) || wait > until || wait < until-time.Second {
+        t.Errorf("Admit = %s, %v, want ErrQuotaExceeded until the next month (%s)", wait, err, until)
+    }
+}
+
+func TestReaderShapesByteRate(t *testing.T) {
+    control := newTrafficTestControl(t, config.TrafficLimits{BytesPerSecond: 1000})
+
+    // The first second of bytes is the burst, the next 500 bytes take half a second
+    start := time.Now()
+    n, err := io.Copy(io.Discard, control.Reader("alice", bytes.NewReader(make([]byte, 1500))))
+    if err != nil || n != 1500 {
+        t.Fatalf("Copy = %d, %v", n, err)
+    }
+    if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+        t.Errorf("1500 bytes at 1000 per second took %s, want about 500ms", elapsed)
+    }
+    if usage := control.Usage.Get("alice"); usage.DayBytes != 1500 {
+        t.Errorf("counted %d bytes, want 1500", usage.DayBytes)
+    }
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/valyala/fasthttp"
+)
+
+var (
+    ErrFingerprintMismatch = errors.New("upstream certificate does not match the pinned fingerprint")
+)
+
+// upstreamDialTimeout bounds connecting to an upstream server
+const upstreamDialTimeout = 10 * time.Second
+
+// upstreamClient is a pooled client for one mapping, together with the mapping
+// and idle timeout it was built from so that changes get a fresh client.
+type upstreamClient struct {
+    mapping     config.DomainMapping
+    idleTimeout time.Duration
+    client      *fasthttp.HostClient
+}
+
+// UpstreamPool holds one long-lived HostClient with keep-alive connections per domain mapping.
+type UpstreamPool struct {
+    clients map[string]*upstreamClient
+    mutex   sync.Mutex
+    Logging *logging.Logging
+}
+
+// NewUpstreamPool creates an empty pool, clients are built on first use.
+func NewUpstreamPool(logging *logging.Logging) *UpstreamPool {
+    return &UpstreamPool{
+        clients: make(map[string]*upstreamClient),
+        Logging: logging,
+    }
+}
+
+// Get returns the client for a mapping, rebuilding it if the mapping or the
+// idle timeout changed since it was created.
+func (p *UpstreamPool) Get(mapping config.DomainMapping, idleTimeout time.Duration) (*fasthttp.HostClient, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    existing, exists := p.clients[mapping.From]
+    if exists && existing.mapping.To == mapping.To && existing.mapping.TLS == mapping.TLS && existing.idleTimeout == idleTimeout {
+        return existing.client, nil
+    }
+
+    client, err := newHostClient(mapping, idleTimeout)
+    if err != nil {
+        return nil, err
+    }
+    if exists {
+        existing.client.CloseIdleConnections()
+    }
+    p.clients[mapping.From] = &upstreamClient{mapping: mapping, idleTimeout: idleTimeout, client: client}
+    p.Logging.Info("Created upstream client", "domain", mapping.From, "address", client.Addr)
+    return client, nil
+}
+
+// Prune drops the clients of mappings that were removed or changed, e.g. by a
+// config reload, and closes their idle connections.
+func (p *UpstreamPool) Prune(cfg *config.Config) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    for name, existing := range p.clients {
+        if mapping, exists := cfg.GetMapping(name); exists && mapping.To == existing.mapping.To && mapping.TLS == existing.mapping.TLS {
+            continue
+        }
+        existing.client.CloseIdleConnections()
+        delete(p.clients, name)
+        p.Logging.Info("Removed upstream client", "domain", name)
+    }
+}
+
+// newHostClient builds a HostClient talking to the mapping's target host.
+// Bodies are streamed, so instead of deadlines for the whole request and
+// response, which would cut off long downloads and event streams, every read
+// and write on the connection must make progress within the idle timeout.
+// An idle timeout of zero disables it.
+func newHostClient(mapping config.DomainMapping, idleTimeout time.Duration) (*fasthttp.HostClient, error) {
+    target, err := url.Parse(mapping.To)
+    if err != nil {
+        return nil, err
+    }
+    isTLS := target.Scheme == "https"
+
+    client := &fasthttp.HostClient{
+        Addr:  fasthttp.AddMissingPort(target.Host, isTLS),
+        IsTLS: isTLS,
+        Dial: func(addr string) (net.Conn, error) {
+            conn, err := fasthttp.DialTimeout(addr, upstreamDialTimeout)
+            if err != nil || idleTimeout <= 0 {
+                return conn, err
+            }
+            return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+        },
+        MaxIdleConnDuration:   90 * time.Second,
+        StreamResponseBody:    true,
+        // Keep response snippets, e.g. Set-Cookie headers, out of the logged errors
+        SecureErrorLogMessage: true,
+    }
+    if isTLS {
+        client.TLSConfig, err = newTLSConfig(target.Hostname(), mapping.TLS)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return client, nil
+}
+
+// newTLSConfig builds the TLS settings for a mapping. Certificates are
+// verified against the system roots unless a CA bundle or insecure mode is configured.
+func newTLSConfig(host string, settings config.MappingTLS) (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        ServerName:         host,
+        InsecureSkipVerify: settings.Insecure,
+    }
+    if settings.ServerName != "" {
+        tlsConfig.ServerName = settings.ServerName
+    }
+
+    if settings.CAFile != "" {
+        pem, err := os.ReadFile(settings.CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in CA bundle %s", settings.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+
+    if settings.PinnedSHA256 != "" {
+        pinned, err := hex.DecodeString(strings.ReplaceAll(settings.PinnedSHA256, ":", ""))
+        if err != nil || len(pinned) != sha256.Size {
+            return nil, fmt.Errorf("invalid pinned SHA-256 fingerprint %q", settings.PinnedSHA256)
+        }
+        tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+            if len(state.PeerCertificates) == 0 {
+                return ErrFingerprintMismatch
+            }
+            fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+            if !bytes.Equal(fingerprint[:], pinned) {
+                return ErrFingerprintMismatch
+            }
+            return nil
+        }
+    }
+    return tlsConfig, nil
+}
+
+// idleTimeoutConn fails a read or write that makes no progress within the
+// timeout, however long the connection has been transferring data before
+type idleTimeoutConn struct {
+    net.Conn
+    timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+    if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+        return 0, err
+    }
+    return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+    if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+        return 0, err
+    }
+    return c.Conn.Write(p)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/config"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+    "github.com/valyala/fasthttp"
+)
+
+// writePEM writes a certificate as a PEM bundle and returns its path
+func writePEM(t *testing.T, der []byte) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// newSelfSignedCert returns a certificate that did not sign the test server's
+func newSelfSignedCert(t *testing.T) []byte {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "Other CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageCertSign,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return der
+}
+
+func TestUpstreamTLS(t *testing.T) {
+    // The test certificate is valid for example.com and 127.0.0.1
+    serverNames := make(chan string, 16)
+    upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    upstream.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+        serverNames <- hello.ServerName
+        return nil, nil
+    }}
+    upstream.StartTLS()
+    defer upstream.Close()
+
+    fingerprint := sha256.Sum256(upstream.Certificate().Raw)
+    goodPin := hex.EncodeToString(fingerprint[:])
+    badPin := hex.EncodeToString(make([]byte, sha256.Size))
+    serverCA := writePEM(t, upstream.Certificate().Raw)
+    otherCA := writePEM(t, newSelfSignedCert(t))
+
+    for _, test := range []struct {
+        name     string
+        settings config.MappingTLS
+        sni      string // Expected server name sent in the handshake
+        wantErr  bool
+    }{
+        {name: "system roots", wantErr: true},
+        {name: "CA bundle", settings: config.MappingTLS{CAFile: serverCA}},
+        {name: "wrong CA bundle", settings: config.MappingTLS{CAFile: otherCA}, wantErr: true},
+        {name: "good pin", settings: config.MappingTLS{CAFile: serverCA, PinnedSHA256: goodPin}},
+        {name: "bad pin", settings: config.MappingTLS{CAFile: serverCA, PinnedSHA256: badPin}, wantErr: true},
+        {name: "good pin without verification", settings: config.MappingTLS{Insecure: true, PinnedSHA256: goodPin}},
+        {name: "bad pin without verification", settings: config.MappingTLS{Insecure: true, PinnedSHA256: badPin}, wantErr: true},
+        {name: "server name override", settings: config.MappingTLS{CAFile: serverCA, ServerName: "example.com"}, sni: "example.com"},
+        {name: "server name the certificate lacks", settings: config.MappingTLS{CAFile: serverCA, ServerName: "other.test"}, sni: "other.test", wantErr: true},
+    } {
+        t.Run(test.name, func(t *testing.T) {
+            client, err := newHostClient(config.DomainMapping{From: "upstream", To: upstream.URL, TLS: test.settings}, 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer client.CloseIdleConnections()
+            for len(serverNames) > 0 {
+                <-serverNames
+            }
+
+            req := fasthttp.AcquireRequest()
+            defer fasthttp.ReleaseRequest(req)
+            resp := fasthttp.AcquireResponse()
+            defer fasthttp.ReleaseResponse(resp)
+            req.SetRequestURI(upstream.URL)
+            err = client.DoTimeout(req, resp, 5*time.Second)
+            if (err != nil) != test.wantErr {
+                t.Fatalf("request err = %v, want an error: %v", err, test.wantErr)
+            }
+            if test.settings.PinnedSHA256 == badPin && !errors.Is(err, ErrFingerprintMismatch) {
+                t.Errorf("err = %v, want ErrFingerprintMismatch", err)
+            }
+            if test.sni != "" {
+                if sni := <-serverNames; sni != test.sni {
+                    t.Errorf("server name = %q, want %q", sni, test.sni)
+                }
+            }
+        })
+    }
+}
+
+func TestUpstreamPoolPrune(t *testing.T) {
+    logger := logging.New(false)
+    logger.Configure(logging.Settings{Level: "error"})
+    pool := NewUpstreamPool(logger)
+    cfg := &config.Config{DomainMappings: []config.DomainMapping{
+        {From: "kept", To: "http://127.0.0.1:1"},
+        {From: "changed", To: "http://127.0.0.1:2"},
+        {From: "removed", To: "http://127.0.0.1:3"},
+    }}
+    for _, mapping := range cfg.DomainMappings {
+        if _, err := pool.Get(mapping, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // What a reload leaves behind
+    cfg.DomainMappings = []config.DomainMapping{
+        {From: "kept", To: "http://127.0.0.1:1"},
+        {From: "changed", To: "http://127.0.0.1:4"},
+    }
+    pool.Prune(cfg)
+    if len(pool.clients) != 1 || pool.clients["kept"] == nil {
+        t.Errorf("clients after Prune = %v, want only the unchanged mapping", pool.clients)
+    }
+}
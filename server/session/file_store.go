@@ -0,0 +1,160 @@
+package session
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/atomicfile"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+// flushInterval is how often activity updates are written to the snapshot file
+const flushInterval = 5 * time.Second
+
+// FileStore is a MemoryStore that keeps a JSON snapshot of its sessions on disk,
+// so that sessions survive a restart. New and revoked sessions are written right
+// away, activity updates are batched.
+type FileStore struct {
+    *MemoryStore
+    path      string
+    dirty     bool
+    dirtyLock sync.Mutex
+    saveLock  sync.Mutex
+    done      chan struct{}
+    stopped   chan struct{}
+    Logging   *logging.Logging
+}
+
+// NewFileStore loads the sessions saved at path, if any, and starts the cleanup and flush processes.
+func NewFileStore(path string, cleanupInterval time.Duration, logging *logging.Logging) (*FileStore, error) {
+    store := &FileStore{
+        MemoryStore: NewMemoryStore(cleanupInterval),
+        path:        path,
+        done:        make(chan struct{}),
+        stopped:     make(chan struct{}),
+        Logging:     logging.Component("session"),
+    }
+
+    data, err := os.ReadFile(path)
+    switch {
+    case errors.Is(err, fs.ErrNotExist):
+        // First start, nothing to restore
+    case err != nil:
+        store.MemoryStore.Close()
+        return nil, fmt.Errorf("failed to read session file: %w", err)
+    default:
+        var sessions map[string]Session
+        if err := json.Unmarshal(data, &sessions); err != nil {
+            store.MemoryStore.Close()
+            return nil, fmt.Errorf("failed to parse session file: %w", err)
+        }
+        store.Logging.Info("Restored sessions", "count", store.restore(sessions), "path", path)
+    }
+
+    go store.flushPeriodically()
+    return store, nil
+}
+
+// CreateSession creates a new session and saves the snapshot.
+func (store *FileStore) CreateSession(username, domainName, targetDomain, clientIP string, limits Limits, quota Quota) (string, int, error) {
+    token, evicted, err := store.MemoryStore.CreateSession(username, domainName, targetDomain, clientIP, limits, quota)
+    if err != nil {
+        return "", 0, err
+    }
+    store.save()
+    return token, evicted, nil
+}
+
+// Touch refreshes a session, the change is written with the next flush.
+func (store *FileStore) Touch(token string) (Session, bool) {
+    session, exists := store.MemoryStore.Touch(token)
+    if exists {
+        store.markDirty()
+    }
+    return session, exists
+}
+
+// Revalidate re-checks every session and saves the snapshot.
+func (store *FileStore) Revalidate(check func(session *Session) bool) []Session {
+    revoked := store.MemoryStore.Revalidate(check)
+    store.save()
+    return revoked
+}
+
+// Revoke deletes the session of a token and saves the snapshot.
+func (store *FileStore) Revoke(token string) bool {
+    revoked := store.MemoryStore.Revoke(token)
+    if revoked {
+        store.save()
+    }
+    return revoked
+}
+
+// RevokeUser deletes every session of a user and saves the snapshot.
+func (store *FileStore) RevokeUser(username string) int {
+    revoked := store.MemoryStore.RevokeUser(username)
+    if revoked > 0 {
+        store.save()
+    }
+    return revoked
+}
+
+// Close stops the background processes and writes a final snapshot.
+func (store *FileStore) Close() {
+    close(store.done)
+    <-store.stopped
+    store.save()
+    store.MemoryStore.Close()
+}
+
+func (store *FileStore) markDirty() {
+    store.dirtyLock.Lock()
+    store.dirty = true
+    store.dirtyLock.Unlock()
+}
+
+// flushPeriodically writes batched activity updates until Close is called
+func (store *FileStore) flushPeriodically() {
+    defer close(store.stopped)
+    ticker := time.NewTicker(flushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-store.done:
+            return
+        case <-ticker.C:
+            store.dirtyLock.Lock()
+            dirty := store.dirty
+            store.dirtyLock.Unlock()
+            if dirty {
+                store.save()
+            }
+        }
+    }
+}
+
+// save atomically replaces the snapshot file with the current sessions
+func (store *FileStore) save() {
+    store.saveLock.Lock()
+    defer store.saveLock.Unlock()
+
+    store.dirtyLock.Lock()
+    store.dirty = false
+    store.dirtyLock.Unlock()
+
+    data, err := json.Marshal(store.snapshot())
+    if err != nil {
+        store.Logging.Error("Failed to encode sessions", "error", err)
+        return
+    }
+
+    // Session tokens are credentials, atomicfile keeps the file private
+    if err := atomicfile.Write(store.path, data); err != nil {
+        store.Logging.Error("Failed to save sessions", "path", store.path, "error", err)
+    }
+}
@@ -0,0 +1,104 @@
+package session
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+func newTestLogger() *logging.Logging {
+    logger := logging.New(false)
+    logger.Configure(logging.Settings{Level: "error"})
+    return logger
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions.json")
+    store, err := NewFileStore(path, time.Minute, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    limits := Limits{IdleTimeout: time.Hour, MaxLifetime: 2 * time.Hour}
+    kept, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", limits, Quota{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    revoked, _, _ := store.CreateSession("bob", "github", "https://github.com", "127.0.0.2", Limits{}, Quota{})
+
+    // New sessions are saved right away, not only on Close
+    if data, _ := os.ReadFile(path); !strings.Contains(string(data), kept) {
+        t.Error("session file lacks the new session before Close")
+    }
+    store.Revoke(revoked)
+    want, _ := store.Lookup(kept)
+    store.Close()
+
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("session file mode = %s, want 0600", info.Mode().Perm())
+    }
+
+    store, err = NewFileStore(path, time.Minute, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    got, exists := store.Lookup(kept)
+    if !exists {
+        t.Fatal("session lost across the restart")
+    }
+    if got.Username != want.Username || got.DomainName != want.DomainName || got.TargetDomain != want.TargetDomain ||
+        got.ClientIP != want.ClientIP || got.Limits != want.Limits || !got.CreatedAt.Equal(want.CreatedAt) || !got.LastActive.Equal(want.LastActive) {
+        t.Errorf("restored session = %+v, want %+v", got, want)
+    }
+    if _, exists := store.Lookup(revoked); exists {
+        t.Error("revoked session restored")
+    }
+}
+
+func TestFileStoreDropsExpiredSessions(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions.json")
+    now := time.Now()
+    sessions := map[string]Session{
+        "live":    {Username: "alice", CreatedAt: now.Add(-time.Minute), LastActive: now, Limits: Limits{MaxLifetime: time.Hour}},
+        "old":     {Username: "alice", CreatedAt: now.Add(-2 * time.Hour), LastActive: now, Limits: Limits{MaxLifetime: time.Hour}},
+        "idle":    {Username: "bob", CreatedAt: now.Add(-time.Hour), LastActive: now.Add(-time.Hour), Limits: Limits{IdleTimeout: time.Minute}},
+        "forever": {Username: "bob", CreatedAt: now.Add(-24 * time.Hour), LastActive: now.Add(-24 * time.Hour)},
+    }
+    data, _ := json.Marshal(sessions)
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    store, err := NewFileStore(path, time.Minute, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    if count := store.Count(); count != 2 {
+        t.Errorf("restored %d sessions, want 2", count)
+    }
+    for token, want := range map[string]bool{"live": true, "old": false, "idle": false, "forever": true} {
+        if _, exists := store.Lookup(token); exists != want {
+            t.Errorf("Lookup(%s) = %v, want %v", token, exists, want)
+        }
+    }
+}
+
+func TestFileStoreCorruptFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sessions.json")
+    if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewFileStore(path, time.Minute, newTestLogger()); err == nil {
+        t.Error("NewFileStore accepted a corrupt file")
+    }
+}
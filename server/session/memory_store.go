@@ -0,0 +1,260 @@
+package session
+
+import (
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// MemoryStore keeps sessions in a map, they are lost when the process exits
+type MemoryStore struct {
+    sessions        map[string]*Session
+    mutex           sync.RWMutex
+    cleanupInterval time.Duration
+    intervalChanged chan struct{} // Restarts the wait of the cleanup process
+    done            chan struct{}
+}
+
+// NewMemoryStore creates a new instance of MemoryStore and starts the cleanup process.
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+    store := &MemoryStore{
+        sessions:        make(map[string]*Session),
+        intervalChanged: make(chan struct{}, 1),
+        done:            make(chan struct{}),
+    }
+    store.SetCleanupInterval(cleanupInterval)
+    go store.cleanupExpiredSessions()
+    return store
+}
+
+// SetCleanupInterval changes how often expired sessions are swept, the next sweep
+// comes one new interval from now.
+func (store *MemoryStore) SetCleanupInterval(interval time.Duration) {
+    if interval <= 0 {
+        interval = DefaultCleanupInterval
+    }
+    store.mutex.Lock()
+    store.cleanupInterval = interval
+    store.mutex.Unlock()
+
+    select {
+    case store.intervalChanged <- struct{}{}:
+    default:
+    }
+}
+
+// CreateSession creates a new session and returns the session token. If the user
+// reached the quota, either the oldest sessions are evicted or ErrTooManySessions is returned.
+func (store *MemoryStore) CreateSession(username, domainName, targetDomain, clientIP string, limits Limits, quota Quota) (string, int, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    now := time.Now()
+    evicted := 0
+    if quota.Max > 0 {
+        tokens := store.userTokens(username, now)
+        if len(tokens) >= quota.Max {
+            if !quota.EvictOldest {
+                return "", 0, ErrTooManySessions
+            }
+            for _, token := range tokens[:len(tokens)-quota.Max+1] {
+                delete(store.sessions, token)
+                evicted++
+            }
+        }
+    }
+
+    sessionToken := uuid.New().String()
+    store.sessions[sessionToken] = &Session{
+        Username:     username,
+        DomainName:   domainName,
+        TargetDomain: targetDomain,
+        CreatedAt:    now,
+        LastActive:   now,
+        ClientIP:     clientIP,
+        Limits:       limits,
+    }
+    return sessionToken, evicted, nil
+}
+
+// userTokens returns the tokens of a user's live sessions, oldest first. The caller must hold the write lock.
+func (store *MemoryStore) userTokens(username string, now time.Time) []string {
+    var tokens []string
+    for token := range store.sessions {
+        if store.sessions[token].Username != username {
+            continue
+        }
+        if _, exists := store.live(token, now); exists {
+            tokens = append(tokens, token)
+        }
+    }
+    sort.Slice(tokens, func(i, j int) bool {
+        return store.sessions[tokens[i]].CreatedAt.Before(store.sessions[tokens[j]].CreatedAt)
+    })
+    return tokens
+}
+
+// Lookup returns a copy of a live session without refreshing it. Expired
+// sessions are removed right away instead of waiting for the next cleanup.
+func (store *MemoryStore) Lookup(token string) (Session, bool) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    session, exists := store.live(token, time.Now())
+    if !exists {
+        return Session{}, false
+    }
+    return *session, true
+}
+
+// Touch validates a session, marks it as active now and returns a copy of it.
+func (store *MemoryStore) Touch(token string) (Session, bool) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    now := time.Now()
+    session, exists := store.live(token, now)
+    if !exists {
+        return Session{}, false
+    }
+    session.LastActive = now
+    return *session, true
+}
+
+// live returns the session for a token, deleting it if it expired. The caller must hold the write lock.
+func (store *MemoryStore) live(token string, now time.Time) (*Session, bool) {
+    session, exists := store.sessions[token]
+    if !exists {
+        return nil, false
+    }
+    if session.Expired(now) {
+        delete(store.sessions, token)
+        return nil, false
+    }
+    return session, true
+}
+
+// Revalidate calls check for every live session while holding the store lock.
+// check may update the session in place and returns false to revoke it.
+// The revoked sessions are returned.
+func (store *MemoryStore) Revalidate(check func(session *Session) bool) []Session {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    var revoked []Session
+    for token, session := range store.sessions {
+        if !check(session) {
+            revoked = append(revoked, *session)
+            delete(store.sessions, token)
+        }
+    }
+    return revoked
+}
+
+// Revoke deletes the session of a token and reports whether it was live.
+func (store *MemoryStore) Revoke(token string) bool {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    _, exists := store.live(token, time.Now())
+    delete(store.sessions, token)
+    return exists
+}
+
+// RevokeUser deletes every session of a user and returns how many were deleted.
+func (store *MemoryStore) RevokeUser(username string) int {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    revoked := 0
+    for token, session := range store.sessions {
+        if session.Username == username {
+            delete(store.sessions, token)
+            revoked++
+        }
+    }
+    return revoked
+}
+
+// Count returns the number of live sessions, expired ones not yet swept are left out.
+func (store *MemoryStore) Count() int {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    now := time.Now()
+    live := 0
+    for _, session := range store.sessions {
+        if !session.Expired(now) {
+            live++
+        }
+    }
+    return live
+}
+
+// cleanupExpiredSessions periodically removes sessions that exceeded their idle timeout or lifetime.
+func (store *MemoryStore) cleanupExpiredSessions() {
+    for {
+        store.mutex.RLock()
+        timer := time.NewTimer(store.cleanupInterval)
+        store.mutex.RUnlock()
+
+        select {
+        case <-store.done:
+            timer.Stop()
+            return
+        case <-store.intervalChanged:
+            timer.Stop()
+            continue
+        case <-timer.C:
+        }
+
+        store.mutex.Lock()
+        now := time.Now()
+        for token, session := range store.sessions {
+            if session.Expired(now) {
+                delete(store.sessions, token)
+            }
+        }
+        store.mutex.Unlock()
+    }
+}
+
+// Close stops the cleanup process.
+func (store *MemoryStore) Close() {
+    close(store.done)
+}
+
+// snapshot returns copies of all live sessions keyed by token
+func (store *MemoryStore) snapshot() map[string]Session {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    now := time.Now()
+    sessions := make(map[string]Session, len(store.sessions))
+    for token, session := range store.sessions {
+        if !session.Expired(now) {
+            sessions[token] = *session
+        }
+    }
+    return sessions
+}
+
+// restore adds previously saved sessions that have not expired yet
+func (store *MemoryStore) restore(sessions map[string]Session) int {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    now := time.Now()
+    restored := 0
+    for token, session := range sessions {
+        if session.Expired(now) {
+            continue
+        }
+        session := session
+        store.sessions[token] = &session
+        restored++
+    }
+    return restored
+}
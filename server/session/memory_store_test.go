@@ -0,0 +1,165 @@
+package session
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestLookupReturnsACopy(t *testing.T) {
+    store := NewMemoryStore(time.Minute)
+    defer store.Close()
+
+    token, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    session, exists := store.Lookup(token)
+    if !exists || session.Username != "alice" {
+        t.Fatalf("Lookup = %+v, %v", session, exists)
+    }
+
+    session.Username = "mallory"
+    session.LastActive = time.Time{}
+    if again, _ := store.Lookup(token); again.Username != "alice" || again.LastActive.IsZero() {
+        t.Errorf("changing the copy changed the stored session: %+v", again)
+    }
+}
+
+func TestTouchKeepsSessionAlive(t *testing.T) {
+    store := NewMemoryStore(time.Minute)
+    defer store.Close()
+
+    limits := Limits{IdleTimeout: 100 * time.Millisecond}
+    token, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", limits, Quota{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Touching more often than the idle timeout keeps the session past it
+    for i := 0; i < 6; i++ {
+        time.Sleep(40 * time.Millisecond)
+        if _, exists := store.Touch(token); !exists {
+            t.Fatalf("session expired after %d touches", i)
+        }
+    }
+
+    // Lookup does not refresh it, so it expires once it stays idle
+    time.Sleep(150 * time.Millisecond)
+    if _, exists := store.Lookup(token); exists {
+        t.Error("idle session still live")
+    }
+    if _, exists := store.Touch(token); exists {
+        t.Error("expired session could be touched")
+    }
+}
+
+func TestMaxLifetimeIgnoresActivity(t *testing.T) {
+    store := NewMemoryStore(time.Minute)
+    defer store.Close()
+
+    token, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{MaxLifetime: 50 * time.Millisecond}, Quota{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(30 * time.Millisecond)
+    store.Touch(token)
+    time.Sleep(30 * time.Millisecond)
+    if _, exists := store.Touch(token); exists {
+        t.Error("session outlived its max lifetime")
+    }
+}
+
+// TestConcurrentCreateTouchExpire is meant to run with the race detector: the
+// sweeper, handshakes, requests and revocations all use the store at once.
+func TestConcurrentCreateTouchExpire(t *testing.T) {
+    store := NewMemoryStore(time.Millisecond)
+    defer store.Close()
+
+    var wg sync.WaitGroup
+    for worker := 0; worker < 8; worker++ {
+        wg.Add(1)
+        go func(worker int) {
+            defer wg.Done()
+            username := fmt.Sprintf("user%d", worker%3)
+            for i := 0; i < 200; i++ {
+                // Every other session expires almost immediately
+                limits := Limits{IdleTimeout: time.Minute}
+                if i%2 == 0 {
+                    limits.IdleTimeout = time.Microsecond
+                }
+                token, _, err := store.CreateSession(username, "github", "https://github.com", "127.0.0.1", limits, Quota{Max: 20, EvictOldest: true})
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+
+                if session, exists := store.Touch(token); exists && session.Username != username {
+                    t.Errorf("Touch returned the session of %s, want %s", session.Username, username)
+                }
+                store.Lookup(token)
+                store.Count()
+                switch i % 50 {
+                case 10:
+                    store.Revoke(token)
+                case 20:
+                    store.RevokeUser(username)
+                case 30:
+                    store.Revalidate(func(session *Session) bool {
+                        session.TargetDomain = "https://github.com"
+                        return true
+                    })
+                }
+            }
+        }(worker)
+    }
+    wg.Wait()
+
+    // Only the long-lived sessions can remain, at most the quota per user
+    if count := store.Count(); count > 3*20 {
+        t.Errorf("%d live sessions, want at most %d", count, 3*20)
+    }
+}
+
+func TestSessionQuota(t *testing.T) {
+    store := NewMemoryStore(time.Minute)
+    defer store.Close()
+
+    quota := Quota{Max: 2}
+    first, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, quota)
+    time.Sleep(time.Millisecond)
+    store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, quota)
+    if _, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, quota); err != ErrTooManySessions {
+        t.Errorf("err = %v, want ErrTooManySessions", err)
+    }
+
+    quota.EvictOldest = true
+    if _, evicted, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, quota); err != nil || evicted != 1 {
+        t.Errorf("evicted %d, err %v, want the oldest session evicted", evicted, err)
+    }
+    if _, exists := store.Lookup(first); exists {
+        t.Error("the oldest session was not the one evicted")
+    }
+}
+
+func TestSetCleanupIntervalTakesEffectRightAway(t *testing.T) {
+    store := NewMemoryStore(time.Hour)
+    defer store.Close()
+    if _, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{MaxLifetime: time.Millisecond}, Quota{}); err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(5 * time.Millisecond)
+
+    // The sweep must not wait for the hour set before
+    store.SetCleanupInterval(10 * time.Millisecond)
+    for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+        store.mutex.RLock()
+        remaining := len(store.sessions)
+        store.mutex.RUnlock()
+        if remaining == 0 {
+            return
+        }
+    }
+    t.Error("expired session not swept after shortening the cleanup interval")
+}
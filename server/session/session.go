@@ -1,68 +1,71 @@
 package session
 
 import (
-    "sync"
+    "errors"
     "time"
-
-    "github.com/google/uuid"
 )
 
+// DefaultCleanupInterval is used when no positive cleanup interval is set
+const DefaultCleanupInterval = 30 * time.Second
+
+// Limits bounds how long a session stays valid. Zero values disable the limit.
+type Limits struct {
+    IdleTimeout time.Duration // Maximum time between two requests
+    MaxLifetime time.Duration // Maximum time since the handshake
+}
+
+// Quota caps the number of live sessions of a user. A zero Max disables it.
+type Quota struct {
+    Max         int
+    EvictOldest bool // End the user's oldest sessions instead of refusing a new one
+}
+
+// ErrTooManySessions is returned by CreateSession when the quota is reached and eviction is off
+var ErrTooManySessions = errors.New("too many sessions")
+
 type Session struct {
     Username     string
+    DomainName   string
     TargetDomain string
+    CreatedAt    time.Time
     LastActive   time.Time
     ClientIP     string // Added to track client IP
+    Limits       Limits
 }
 
-type SessionStore struct {
-    sessions map[string]*Session
-    mutex    sync.RWMutex
-}
-
-// NewSessionStore creates a new instance of SessionStore and starts the cleanup process.
-func NewSessionStore() *SessionStore {
-    store := &SessionStore{
-        sessions: make(map[string]*Session),
+// Expired reports whether the session exceeded its idle timeout or lifetime at the given time.
+func (s *Session) Expired(now time.Time) bool {
+    if s.Limits.IdleTimeout > 0 && now.Sub(s.LastActive) > s.Limits.IdleTimeout {
+        return true
     }
-    go store.cleanupExpiredSessions()
-    return store
+    return s.Limits.MaxLifetime > 0 && now.Sub(s.CreatedAt) > s.Limits.MaxLifetime
 }
 
-// CreateSession creates a new session and returns the session token.
-func (store *SessionStore) CreateSession(username, targetDomain, clientIP string) string {
-    store.mutex.Lock()
-    defer store.mutex.Unlock()
-
-    sessionToken := uuid.New().String()
-    store.sessions[sessionToken] = &Session{
-        Username:     username,
-        TargetDomain: targetDomain,
-        LastActive:   time.Now(),
-        ClientIP:     clientIP,
-    }
-    return sessionToken
+// Counter is implemented by stores that keep their sessions. Stateless
+// stores cannot tell how many of their tokens are still in use.
+type Counter interface {
+    // Count returns the number of live sessions.
+    Count() int
 }
 
-// GetSession retrieves a session by its token.
-func (store *SessionStore) GetSession(token string) (*Session, bool) {
-    store.mutex.RLock()
-    defer store.mutex.RUnlock()
-
-    session, exists := store.sessions[token]
-    return session, exists
+// SessionStore keeps track of the sessions created by handshakes
+type SessionStore interface {
+    // CreateSession creates a new session within the user's quota and returns
+    // the session token and the number of sessions evicted to make room.
+    CreateSession(username, domainName, targetDomain, clientIP string, limits Limits, quota Quota) (string, int, error)
+    // Lookup returns a copy of a live session without refreshing it.
+    Lookup(token string) (Session, bool)
+    // Touch validates a session, marks it as active now and returns a copy of it.
+    Touch(token string) (Session, bool)
+    // Revalidate calls check for every live session, check may update the
+    // session in place and returns false to revoke it.
+    Revalidate(check func(session *Session) bool) []Session
+    // Revoke ends the session of a token and reports whether it existed.
+    Revoke(token string) bool
+    // RevokeUser ends every session of a user and returns how many were ended.
+    RevokeUser(username string) int
+    // SetCleanupInterval changes how often expired sessions are swept.
+    SetCleanupInterval(interval time.Duration)
+    // Close stops background work and releases the store.
+    Close()
 }
-
-// cleanupExpiredSessions removes sessions that have been inactive for more than 1 minute.
-func (store *SessionStore) cleanupExpiredSessions() {
-    ticker := time.NewTicker(30 * time.Second)
-    defer ticker.Stop()
-    for range ticker.C {
-        store.mutex.Lock()
-        for token, session := range store.sessions {
-            if time.Since(session.LastActive) > time.Minute {
-                delete(store.sessions, token)
-            }
-        }
-        store.mutex.Unlock()
-    }
-}
\ No newline at end of file
@@ -0,0 +1,231 @@
+package session
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+    "sync"
+    "time"
+)
+
+// tokenVersion prefixes every signed token so the format can evolve
+const tokenVersion = "v1"
+
+// DefaultTokenLifetime bounds signed tokens of sessions without a maximum lifetime
+const DefaultTokenLifetime = 24 * time.Hour
+
+var (
+    ErrMalformedToken = errors.New("malformed session token")
+    ErrUnknownKey     = errors.New("session token signed with an unknown key")
+    ErrBadSignature   = errors.New("session token signature mismatch")
+    ErrTokenExpired   = errors.New("session token expired")
+    ErrTokenRevoked   = errors.New("session token revoked")
+)
+
+// tokenPayload is the signed content of a stateless token
+type tokenPayload struct {
+    Username     string `json:"u"`
+    DomainName   string `json:"d"`
+    TargetDomain string `json:"t"`
+    ClientIP     string `json:"ip"`
+    IssuedAt     int64  `json:"iat"` // Unix milliseconds, RevokeUser needs more than seconds
+    ExpiresAt    int64  `json:"exp"`
+}
+
+// TokenStore issues HMAC-signed stateless tokens of the form
+// v1.<key id>.<payload>.<signature>. Any replica that knows the signing
+// key can verify them, no session state is shared or kept.
+//
+// Idle timeouts cannot be enforced without state, a token stays valid until
+// it expires or Validate rejects it. Validate is called on every lookup and
+// takes the place of Revalidate, e.g. to reject users removed from the config.
+//
+// Revocations are the only state kept. They are held in memory until the
+// revoked tokens expire and are neither persisted nor shared with replicas.
+type TokenStore struct {
+    keys         map[string][]byte
+    activeID     string
+    revoked      map[string]time.Time // Revoked token -> its expiry
+    revokedUsers map[string]time.Time // User -> tokens issued up to this millisecond are revoked, one entry per user
+    mutex        sync.RWMutex
+    Validate     func(session *Session) bool
+}
+
+// NewTokenStore creates a token store that signs with the key activeID
+// and accepts tokens signed with any of the keys.
+func NewTokenStore(keys map[string][]byte, activeID string) *TokenStore {
+    store := &TokenStore{
+        revoked:      make(map[string]time.Time),
+        revokedUsers: make(map[string]time.Time),
+    }
+    store.SetKeys(keys, activeID)
+    return store
+}
+
+// SetKeys replaces the signing keys, old keys can be kept to accept tokens issued before a rotation.
+func (store *TokenStore) SetKeys(keys map[string][]byte, activeID string) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.keys = keys
+    store.activeID = activeID
+}
+
+// CreateSession signs a new token for the session. Issued tokens are not
+// tracked, so the quota cannot be enforced and is ignored.
+func (store *TokenStore) CreateSession(username, domainName, targetDomain, clientIP string, limits Limits, quota Quota) (string, int, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    now := time.Now()
+    // A token issued in the millisecond of a revocation would be rejected right away
+    if revokedAt, exists := store.revokedUsers[username]; exists && now.UnixMilli() <= revokedAt.UnixMilli() {
+        now = revokedAt.Truncate(time.Millisecond).Add(time.Millisecond)
+    }
+    lifetime := limits.MaxLifetime
+    if lifetime <= 0 {
+        lifetime = DefaultTokenLifetime
+    }
+
+    // Marshalling a struct of strings and integers cannot fail
+    payload, _ := json.Marshal(tokenPayload{
+        Username:     username,
+        DomainName:   domainName,
+        TargetDomain: targetDomain,
+        ClientIP:     clientIP,
+        IssuedAt:     now.UnixMilli(),
+        ExpiresAt:    now.Add(lifetime).Unix(),
+    })
+
+    signed := tokenVersion + "." + store.activeID + "." + base64.RawURLEncoding.EncodeToString(payload)
+    return signed + "." + sign(store.keys[store.activeID], signed), 0, nil
+}
+
+// Lookup verifies a token and returns the session it describes.
+func (store *TokenStore) Lookup(token string) (Session, bool) {
+    session, err := store.verify(token)
+    if err != nil {
+        return Session{}, false
+    }
+    if store.Validate != nil && !store.Validate(&session) {
+        return Session{}, false
+    }
+    return session, true
+}
+
+// Touch is the same as Lookup, there is no activity to record.
+func (store *TokenStore) Touch(token string) (Session, bool) {
+    return store.Lookup(token)
+}
+
+// Revalidate has nothing to iterate, tokens are checked with Validate on lookup.
+func (store *TokenStore) Revalidate(check func(session *Session) bool) []Session {
+    return nil
+}
+
+// Revoke rejects a token from now on and reports whether it was valid.
+func (store *TokenStore) Revoke(token string) bool {
+    session, err := store.verify(token)
+    if err != nil {
+        return false
+    }
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    store.pruneRevocations(time.Now())
+    store.revoked[token] = session.CreatedAt.Add(session.Limits.MaxLifetime)
+    return true
+}
+
+// RevokeUser rejects every token issued to a user until now. Tokens are not
+// tracked, so the number of revoked sessions is unknown and 0 is returned.
+func (store *TokenStore) RevokeUser(username string) int {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    now := time.Now()
+    store.pruneRevocations(now)
+    store.revokedUsers[username] = now
+    return 0
+}
+
+// pruneRevocations forgets revocations of tokens that expired anyway. The caller must hold the write lock.
+func (store *TokenStore) pruneRevocations(now time.Time) {
+    for token, expiresAt := range store.revoked {
+        if now.After(expiresAt) {
+            delete(store.revoked, token)
+        }
+    }
+}
+
+// SetCleanupInterval does nothing, there are no sessions to clean up.
+func (store *TokenStore) SetCleanupInterval(interval time.Duration) {}
+
+// Close does nothing, there is no background work.
+func (store *TokenStore) Close() {}
+
+// verify checks the signature and expiry of a token and decodes it
+func (store *TokenStore) verify(token string) (Session, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 4 || parts[0] != tokenVersion {
+        return Session{}, ErrMalformedToken
+    }
+
+    store.mutex.RLock()
+    key, exists := store.keys[parts[1]]
+    _, revoked := store.revoked[token]
+    store.mutex.RUnlock()
+    if !exists {
+        return Session{}, ErrUnknownKey
+    }
+    if revoked {
+        return Session{}, ErrTokenRevoked
+    }
+
+    signed := strings.Join(parts[:3], ".")
+    if !hmac.Equal([]byte(sign(key, signed)), []byte(parts[3])) {
+        return Session{}, ErrBadSignature
+    }
+
+    data, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return Session{}, ErrMalformedToken
+    }
+    var payload tokenPayload
+    if err := json.Unmarshal(data, &payload); err != nil {
+        return Session{}, ErrMalformedToken
+    }
+
+    now := time.Now()
+    expiresAt := time.Unix(payload.ExpiresAt, 0)
+    if now.After(expiresAt) {
+        return Session{}, ErrTokenExpired
+    }
+
+    issuedAt := time.UnixMilli(payload.IssuedAt)
+    store.mutex.RLock()
+    revokedAt, userRevoked := store.revokedUsers[payload.Username]
+    store.mutex.RUnlock()
+    if userRevoked && payload.IssuedAt <= revokedAt.UnixMilli() {
+        return Session{}, ErrTokenRevoked
+    }
+
+    return Session{
+        Username:     payload.Username,
+        DomainName:   payload.DomainName,
+        TargetDomain: payload.TargetDomain,
+        CreatedAt:    issuedAt,
+        LastActive:   now,
+        ClientIP:     payload.ClientIP,
+        Limits:       Limits{MaxLifetime: expiresAt.Sub(issuedAt)},
+    }, nil
+}
+
+// sign returns the base64url encoded HMAC-SHA256 of data
+func sign(key []byte, data string) string {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
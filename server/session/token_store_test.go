@@ -0,0 +1,140 @@
+package session
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+var testKeys = map[string][]byte{
+    "old": []byte("old-secret-0123456789abcdef"),
+    "new": []byte("new-secret-0123456789abcdef"),
+}
+
+// encodeTestPayload encodes a payload the way CreateSession does
+func encodeTestPayload(payload tokenPayload) string {
+    data, _ := json.Marshal(payload)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+    store := NewTokenStore(testKeys, "new")
+    token, _, err := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{MaxLifetime: time.Hour}, Quota{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(token, "v1.new.") {
+        t.Errorf("token %q not signed with the active key", token)
+    }
+
+    session, exists := store.Lookup(token)
+    if !exists {
+        t.Fatal("valid token rejected")
+    }
+    if session.Username != "alice" || session.DomainName != "github" || session.TargetDomain != "https://github.com" || session.ClientIP != "127.0.0.1" {
+        t.Errorf("Lookup = %+v", session)
+    }
+    if lifetime := session.Limits.MaxLifetime; lifetime < time.Hour-time.Second || lifetime > time.Hour {
+        t.Errorf("MaxLifetime = %s, want an hour", lifetime)
+    }
+}
+
+func TestTokenVerifyErrors(t *testing.T) {
+    store := NewTokenStore(testKeys, "new")
+    token, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+    parts := strings.Split(token, ".")
+
+    // CreateSession cannot issue expired tokens, so sign an expired payload by hand
+    expiredToken := strings.Join(parts[:2], ".") + "." + encodeTestPayload(tokenPayload{Username: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+    expiredToken += "." + sign(testKeys["new"], expiredToken)
+
+    for _, test := range []struct {
+        name  string
+        token string
+        want  error
+    }{
+        {"wrong version", "v0." + strings.Join(parts[1:], "."), ErrMalformedToken},
+        {"missing part", strings.Join(parts[:3], "."), ErrMalformedToken},
+        {"unknown key", parts[0] + ".gone." + strings.Join(parts[2:], "."), ErrUnknownKey},
+        {"tampered payload", strings.Join(parts[:2], ".") + "." + encodeTestPayload(tokenPayload{Username: "mallory"}) + "." + parts[3], ErrBadSignature},
+        {"expired", expiredToken, ErrTokenExpired},
+    } {
+        if _, err := store.verify(test.token); err != test.want {
+            t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+        }
+    }
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+    store := NewTokenStore(testKeys, "old")
+    token, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+
+    // Keeping the old key accepts its tokens after the rotation
+    store.SetKeys(testKeys, "new")
+    if _, exists := store.Lookup(token); !exists {
+        t.Error("token of the previous key rejected while the key is kept")
+    }
+
+    store.SetKeys(map[string][]byte{"new": testKeys["new"]}, "new")
+    if _, err := store.verify(token); err != ErrUnknownKey {
+        t.Errorf("err = %v, want ErrUnknownKey once the old key is removed", err)
+    }
+}
+
+func TestTokenRevocation(t *testing.T) {
+    store := NewTokenStore(testKeys, "new")
+    first, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+    second, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.2", Limits{}, Quota{})
+
+    if !store.Revoke(first) {
+        t.Error("Revoke of a valid token returned false")
+    }
+    if _, exists := store.Lookup(first); exists {
+        t.Error("revoked token still accepted")
+    }
+    if _, exists := store.Lookup(second); !exists {
+        t.Error("Revoke rejected another token of the same user")
+    }
+    if store.Revoke("v1.new.bogus.bogus") {
+        t.Error("Revoke of an invalid token returned true")
+    }
+}
+
+func TestTokenIssuedRightAfterRevokeUserIsValid(t *testing.T) {
+    store := NewTokenStore(testKeys, "new")
+    before, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+    other, _, _ := store.CreateSession("bob", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+
+    // A handshake in the same instant as the revocation must not be dead on arrival
+    store.RevokeUser("alice")
+    after, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+
+    if _, exists := store.Lookup(before); exists {
+        t.Error("token issued before RevokeUser still accepted")
+    }
+    if _, exists := store.Lookup(after); !exists {
+        t.Error("token issued right after RevokeUser rejected")
+    }
+    if _, exists := store.Lookup(other); !exists {
+        t.Error("RevokeUser rejected the token of another user")
+    }
+}
+
+func TestTokenValidate(t *testing.T) {
+    store := NewTokenStore(testKeys, "new")
+    store.Validate = func(session *Session) bool {
+        session.TargetDomain = "https://example.com"
+        return session.Username != "mallory"
+    }
+    alice, _, _ := store.CreateSession("alice", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+    mallory, _, _ := store.CreateSession("mallory", "github", "https://github.com", "127.0.0.1", Limits{}, Quota{})
+
+    if session, exists := store.Lookup(alice); !exists || session.TargetDomain != "https://example.com" {
+        t.Errorf("Lookup = %+v, %v, want the target set by Validate", session, exists)
+    }
+    if _, exists := store.Touch(mallory); exists {
+        t.Error("token rejected by Validate accepted")
+    }
+}
@@ -0,0 +1,106 @@
+package traffic
+
+import (
+    "sync"
+    "time"
+)
+
+// Bucket is a token bucket refilled at a fixed rate up to its burst size.
+// A rate of zero or less disables the limit.
+type Bucket struct {
+    rate     float64 // Tokens added per second
+    burst    float64
+    tokens   float64
+    last     time.Time
+    lastUsed time.Time
+    mutex    sync.Mutex
+}
+
+// NewBucket creates a full bucket
+func NewBucket(rate float64, burst int) *Bucket {
+    now := time.Now()
+    bucket := &Bucket{last: now, lastUsed: now}
+    bucket.SetLimit(rate, burst)
+    bucket.tokens = bucket.burst
+    return bucket
+}
+
+// SetLimit changes the rate and burst size, a burst below one uses the rate rounded up
+func (b *Bucket) SetLimit(rate float64, burst int) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    b.refill(time.Now())
+    b.rate = rate
+    b.burst = float64(burst)
+    if b.burst < 1 {
+        b.burst = rate
+        if b.burst < 1 {
+            b.burst = 1
+        }
+    }
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+}
+
+// Allow takes one token if available, otherwise it returns how long to wait for one
+func (b *Bucket) Allow() (time.Duration, bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    now := time.Now()
+    b.lastUsed = now
+    if b.rate <= 0 {
+        return 0, true
+    }
+    b.refill(now)
+    if b.tokens >= 1 {
+        b.tokens--
+        return 0, true
+    }
+    return b.delay(1 - b.tokens), false
+}
+
+// Take removes n tokens even if that leaves the bucket in debt and returns how
+// long the caller should wait until the debt is paid off. It is used to shape
+// byte streams, where a read or write has already happened.
+func (b *Bucket) Take(n int) time.Duration {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    now := time.Now()
+    b.lastUsed = now
+    if b.rate <= 0 {
+        return 0
+    }
+    b.refill(now)
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return b.delay(-b.tokens)
+}
+
+// LastUsed returns when the bucket was last asked for tokens
+func (b *Bucket) LastUsed() time.Time {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.lastUsed
+}
+
+// refill adds the tokens earned since the last refill. The caller must hold the lock.
+func (b *Bucket) refill(now time.Time) {
+    if b.rate > 0 {
+        b.tokens += now.Sub(b.last).Seconds() * b.rate
+        if b.tokens > b.burst {
+            b.tokens = b.burst
+        }
+    }
+    b.last = now
+}
+
+// delay returns how long it takes to earn the given number of tokens. The caller must hold the lock.
+func (b *Bucket) delay(tokens float64) time.Duration {
+    return time.Duration(tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,67 @@
+package traffic
+
+import (
+    "testing"
+    "time"
+)
+
+func TestBucketAllow(t *testing.T) {
+    bucket := NewBucket(10, 2)
+    for i := 0; i < 2; i++ {
+        if _, ok := bucket.Allow(); !ok {
+            t.Fatalf("request %d of the burst refused", i+1)
+        }
+    }
+    wait, ok := bucket.Allow()
+    if ok || wait <= 0 || wait > 100*time.Millisecond {
+        t.Errorf("Allow on an empty bucket = %s, %v, want a wait of up to 100ms", wait, ok)
+    }
+
+    // A second earns ten tokens, but the bucket holds only two
+    bucket.last = bucket.last.Add(-time.Second)
+    for i := 0; i < 2; i++ {
+        if _, ok := bucket.Allow(); !ok {
+            t.Fatalf("request %d after the refill refused", i+1)
+        }
+    }
+    if _, ok := bucket.Allow(); ok {
+        t.Error("refill exceeded the burst size")
+    }
+}
+
+func TestBucketTakeDebt(t *testing.T) {
+    bucket := NewBucket(100, 100)
+    if wait := bucket.Take(100); wait != 0 {
+        t.Errorf("Take of the burst = %s, want no wait", wait)
+    }
+    // 50 tokens in debt take half a second at 100 per second
+    if wait := bucket.Take(50); wait < 490*time.Millisecond || wait > 500*time.Millisecond {
+        t.Errorf("Take into debt = %s, want 500ms", wait)
+    }
+}
+
+func TestBucketUnlimited(t *testing.T) {
+    bucket := NewBucket(0, 0)
+    for i := 0; i < 100; i++ {
+        if _, ok := bucket.Allow(); !ok {
+            t.Fatal("a bucket without rate refused a request")
+        }
+    }
+    if wait := bucket.Take(1 << 30); wait != 0 {
+        t.Errorf("Take = %s, want no wait without a rate", wait)
+    }
+}
+
+func TestBucketSetLimit(t *testing.T) {
+    bucket := NewBucket(10, 10)
+    // Lowering the burst drops the tokens above it, a burst of zero uses the rate
+    bucket.SetLimit(2, 0)
+    for i := 0; i < 2; i++ {
+        if _, ok := bucket.Allow(); !ok {
+            t.Fatalf("request %d of the new burst refused", i+1)
+        }
+    }
+    if _, ok := bucket.Allow(); ok {
+        t.Error("tokens above the lowered burst kept")
+    }
+}
@@ -0,0 +1,182 @@
+package traffic
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/atomicfile"
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+// usageFlushInterval is how often usage is written to disk and logged
+const usageFlushInterval = time.Minute
+
+// Calendar periods are UTC, so quotas reset at the same moment on every server
+const (
+    dayLayout   = "2006-01-02"
+    monthLayout = "2006-01"
+)
+
+// Usage is the number of bytes a user transferred in the current day and month
+type Usage struct {
+    Day        string `json:"day"` // 2006-01-02, UTC
+    DayBytes   int64  `json:"day_bytes"`
+    Month      string `json:"month"` // 2006-01, UTC
+    MonthBytes int64  `json:"month_bytes"`
+}
+
+// rollOver resets the counters of periods that ended before now
+func (u *Usage) rollOver(now time.Time) {
+    now = now.UTC()
+    if day := now.Format(dayLayout); u.Day != day {
+        u.Day = day
+        u.DayBytes = 0
+    }
+    if month := now.Format(monthLayout); u.Month != month {
+        u.Month = month
+        u.MonthBytes = 0
+    }
+}
+
+// NextDay returns when the current daily quota period ends
+func NextDay(now time.Time) time.Time {
+    now = now.UTC()
+    return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// NextMonth returns when the current monthly quota period ends
+func NextMonth(now time.Time) time.Time {
+    now = now.UTC()
+    return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// UsageStore counts the bytes transferred per user and keeps the counters in a
+// JSON file, so that daily and monthly quotas survive a restart. The file is
+// written periodically and on Close, changed usage is logged at the same time.
+type UsageStore struct {
+    path    string
+    usage   map[string]*Usage
+    changed map[string]bool // Users whose usage changed since the last flush
+    mutex   sync.Mutex
+    done    chan struct{}
+    stopped chan struct{}
+    Logging *logging.Logging
+}
+
+// NewUsageStore loads the usage saved at path, if any, and starts the flush process.
+func NewUsageStore(path string, logging *logging.Logging) (*UsageStore, error) {
+    store := &UsageStore{
+        path:    path,
+        usage:   make(map[string]*Usage),
+        changed: make(map[string]bool),
+        done:    make(chan struct{}),
+        stopped: make(chan struct{}),
+        Logging: logging.Component("traffic"),
+    }
+
+    data, err := os.ReadFile(path)
+    switch {
+    case errors.Is(err, fs.ErrNotExist):
+        // First start, nothing to restore
+    case err != nil:
+        return nil, fmt.Errorf("failed to read usage file: %w", err)
+    default:
+        if err := json.Unmarshal(data, &store.usage); err != nil {
+            return nil, fmt.Errorf("failed to parse usage file: %w", err)
+        }
+        store.Logging.Info("Restored traffic usage", "users", len(store.usage), "path", path)
+    }
+
+    go store.flushPeriodically()
+    return store, nil
+}
+
+// Add counts transferred bytes for a user and returns the updated usage
+func (store *UsageStore) Add(username string, bytes int64) Usage {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    usage := store.current(username)
+    usage.DayBytes += bytes
+    usage.MonthBytes += bytes
+    store.changed[username] = true
+    return *usage
+}
+
+// Get returns the usage of a user in the current periods
+func (store *UsageStore) Get(username string) Usage {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+    return *store.current(username)
+}
+
+// Close stops the flush process and writes the usage a last time.
+func (store *UsageStore) Close() {
+    close(store.done)
+    <-store.stopped
+    store.flush()
+}
+
+// current returns the usage record of a user rolled over to now. The caller must hold the lock.
+func (store *UsageStore) current(username string) *Usage {
+    usage, exists := store.usage[username]
+    if !exists {
+        usage = &Usage{}
+        store.usage[username] = usage
+    }
+    usage.rollOver(time.Now())
+    return usage
+}
+
+// flushPeriodically saves and logs changed usage until Close is called
+func (store *UsageStore) flushPeriodically() {
+    defer close(store.stopped)
+    ticker := time.NewTicker(usageFlushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-store.done:
+            return
+        case <-ticker.C:
+            store.flush()
+        }
+    }
+}
+
+// flush logs the usage of users with new traffic and saves the file if anything changed
+func (store *UsageStore) flush() {
+    store.mutex.Lock()
+    if len(store.changed) == 0 {
+        store.mutex.Unlock()
+        return
+    }
+
+    usernames := make([]string, 0, len(store.changed))
+    for username := range store.changed {
+        usernames = append(usernames, username)
+    }
+    sort.Strings(usernames)
+    for _, username := range usernames {
+        usage := store.usage[username]
+        store.Logging.Info("Traffic usage", "user", username,
+            "day", usage.Day, "day_bytes", usage.DayBytes, "month", usage.Month, "month_bytes", usage.MonthBytes)
+    }
+    store.changed = make(map[string]bool)
+
+    data, err := json.Marshal(store.usage)
+    store.mutex.Unlock()
+    if err != nil {
+        store.Logging.Error("Failed to encode traffic usage", "error", err)
+        return
+    }
+
+    if err := atomicfile.Write(store.path, data); err != nil {
+        store.Logging.Error("Failed to save traffic usage", "path", store.path, "error", err)
+    }
+}
@@ -0,0 +1,104 @@
+package traffic
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/efebaykaraa/domain-dedicated-isp-bypass/server/logging"
+)
+
+func newTestLogger() *logging.Logging {
+    logger := logging.New(false)
+    logger.Configure(logging.Settings{Level: "error"})
+    return logger
+}
+
+func TestUsageRollOver(t *testing.T) {
+    usage := Usage{Day: "2026-01-31", DayBytes: 5, Month: "2026-01", MonthBytes: 9}
+
+    usage.rollOver(time.Date(2026, 1, 31, 23, 59, 0, 0, time.UTC))
+    if usage.DayBytes != 5 || usage.MonthBytes != 9 {
+        t.Errorf("usage within the periods = %+v, want it kept", usage)
+    }
+
+    // Periods are UTC, 00:30 in UTC+1 is still January 31st
+    usage.rollOver(time.Date(2026, 2, 1, 0, 30, 0, 0, time.FixedZone("UTC+1", 3600)))
+    if usage.DayBytes != 5 || usage.MonthBytes != 9 {
+        t.Errorf("usage before UTC midnight = %+v, want it kept", usage)
+    }
+
+    usage.rollOver(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+    if usage != (Usage{Day: "2026-02-01", Month: "2026-02"}) {
+        t.Errorf("usage in a new month = %+v, want both periods reset", usage)
+    }
+
+    usage.DayBytes, usage.MonthBytes = 5, 9
+    usage.rollOver(time.Date(2026, 2, 2, 0, 0, 0, 0, time.UTC))
+    if usage != (Usage{Day: "2026-02-02", Month: "2026-02", MonthBytes: 9}) {
+        t.Errorf("usage on a new day = %+v, want only the day reset", usage)
+    }
+}
+
+func TestNextPeriod(t *testing.T) {
+    now := time.Date(2026, 12, 31, 15, 0, 0, 0, time.UTC)
+    if next := NextDay(now); !next.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("NextDay = %s", next)
+    }
+    if next := NextMonth(now); !next.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("NextMonth = %s", next)
+    }
+}
+
+func TestUsagePersistence(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "usage.json")
+    store, err := NewUsageStore(path, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    store.Add("alice", 100)
+    store.Add("alice", 20)
+    store.Add("bob", 7)
+    store.Close()
+
+    // A restart keeps the usage of the current periods
+    store, err = NewUsageStore(path, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    if usage := store.Get("alice"); usage.DayBytes != 120 || usage.MonthBytes != 120 {
+        t.Errorf("alice after restart = %+v, want 120 bytes", usage)
+    }
+    if usage := store.Get("bob"); usage.DayBytes != 7 {
+        t.Errorf("bob after restart = %+v, want 7 bytes", usage)
+    }
+}
+
+func TestUsageOfPastPeriodsIsReset(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "usage.json")
+    data := `{"alice": {"day": "2000-01-01", "day_bytes": 100, "month": "2000-01", "month_bytes": 100}}`
+    if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    store, err := NewUsageStore(path, newTestLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    if usage := store.Get("alice"); usage.DayBytes != 0 || usage.MonthBytes != 0 {
+        t.Errorf("restored usage of past periods = %+v, want it reset", usage)
+    }
+}
+
+func TestCorruptUsageFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "usage.json")
+    if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewUsageStore(path, newTestLogger()); err == nil {
+        t.Error("NewUsageStore accepted a corrupt file")
+    }
+}